@@ -0,0 +1,273 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/trace"
+)
+
+const (
+	defaultCircuitOpenFor  = 10 * time.Second
+	defaultCircuitWindow   = time.Minute
+	defaultCircuitMinDials = 10
+	// defaultCircuitIdleTimeout is long enough for breakers not to be dropped between the dials of a connection pool.
+	defaultCircuitIdleTimeout = 10 * time.Minute
+)
+
+// ErrCircuitOpen is returned, wrapped in a `CircuitOpenError`, for dials to an address whose circuit breaker is open.
+// Such dials are reported with the `circuit_open` failure reason.
+var ErrCircuitOpen = errors.New("conntrack: circuit breaker is open")
+
+// CircuitOpenError is returned for dials to an address whose circuit breaker is open, see `DialWithCircuitBreaker`.
+type CircuitOpenError struct {
+	Addr string
+	// Until is when the breaker lets a trial dial through again.
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v: %s until %s", ErrCircuitOpen, e.Addr, e.Until.Format(time.RFC3339))
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// CircuitBreakerConfig tells when `DialWithCircuitBreaker` opens the breaker of an address. At least one of
+// ConsecutiveFailures and FailureRatio must be set for it to ever open.
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures opens the breaker once that many dials in a row failed. A value of 0 disables it.
+	ConsecutiveFailures int
+	// FailureRatio opens the breaker once the ratio of failed dials within Window reaches it, e.g. 0.5, given that
+	// there were at least MinDials dials. A value of 0 disables it.
+	FailureRatio float64
+	// MinDials is the number of dials within Window needed for FailureRatio to apply. The default is 10.
+	MinDials int
+	// Window is the duration over which the failure ratio is computed. The default is a minute.
+	Window time.Duration
+	// OpenFor is how long an open breaker fails dials fast, before it turns half-open and lets a single trial dial
+	// through to decide whether to close again. The default is 10 seconds.
+	OpenFor time.Duration
+	// IdleTimeout is how long a breaker is kept without any dial to its address, after which it is dropped along with
+	// its `dialer_circuit_breaker_state` series, so that addresses that are gone, e.g. rotated backend IPs, don't leak
+	// them. For open and half-open breakers, it only starts once they would let a trial dial through. The default is
+	// 10 minutes.
+	IdleTimeout time.Duration
+}
+
+type circuitState int
+
+// The values of the states are the ones of the `dialer_circuit_breaker_state` gauge.
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// circuitBreakers hold the circuit breaker of every address dialed by a dialer, for each of the dialer names it is
+// used with, see `DialNameToContext`.
+type circuitBreakers struct {
+	cfg  CircuitBreakerConfig
+	opts *dialerOpts
+
+	mu        sync.Mutex
+	byKey     map[circuitBreakerKey]*circuitBreaker
+	lastSweep time.Time
+}
+
+type circuitBreakerKey struct {
+	name string
+	addr string
+}
+
+type circuitBreaker struct {
+	circuitBreakerKey
+	state circuitState
+	// event traces the transitions of the breaker, for as long as the breaker is kept.
+	event trace.EventLog
+	// lastDial is the time of the last dial to the address, and dialsInFlight the number of dials let through that
+	// weren't reported to `done` yet, which both keep the breaker from being dropped.
+	lastDial      time.Time
+	dialsInFlight int
+
+	consecutiveFailures int
+	windowStart         time.Time
+	dials               int
+	failures            int
+	retryAt             time.Time
+	trialInFlight       bool
+	// generation is incremented on every transition, so that the outcomes of dials let through before it are ignored.
+	generation uint64
+}
+
+// circuitDial is a dial let through by a circuit breaker, whose outcome is reported to `done`.
+type circuitDial struct {
+	breaker    *circuitBreaker
+	generation uint64
+	// trial is set for the single dial a half-open breaker lets through, the only one to decide whether it closes.
+	trial bool
+}
+
+func newCircuitBreakers(cfg CircuitBreakerConfig, opts *dialerOpts) *circuitBreakers {
+	if cfg.MinDials <= 0 {
+		cfg.MinDials = defaultCircuitMinDials
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultCircuitWindow
+	}
+	if cfg.OpenFor <= 0 {
+		cfg.OpenFor = defaultCircuitOpenFor
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultCircuitIdleTimeout
+	}
+	return &circuitBreakers{cfg: cfg, opts: opts, byKey: make(map[circuitBreakerKey]*circuitBreaker), lastSweep: time.Now()}
+}
+
+// allow lets a dial of the given dialer name to the given address go ahead, or returns a `CircuitOpenError` if its
+// breaker is open. The outcome of the dial must be reported to `done`.
+func (b *circuitBreakers) allow(dialerName string, addr string) (circuitDial, error) {
+	if b == nil {
+		return circuitDial{}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.lastSweep) > b.cfg.IdleTimeout {
+		b.sweep(now)
+	}
+	key := circuitBreakerKey{name: dialerName, addr: addr}
+	breaker, ok := b.byKey[key]
+	if !ok {
+		breaker = &circuitBreaker{circuitBreakerKey: key, windowStart: now}
+		if b.opts.tracing {
+			breaker.event = trace.NewEventLog(fmt.Sprintf("net.ClientConn.%s", dialerName), fmt.Sprintf("circuit breaker %v", addr))
+		}
+		b.byKey[key] = breaker
+		if b.opts.monitoring {
+			b.opts.metrics.reportDialerCircuitBreakerState(dialerName, addr, circuitClosed)
+		}
+	}
+	breaker.lastDial = now
+	switch breaker.state {
+	case circuitOpen:
+		if time.Now().Before(breaker.retryAt) {
+			return circuitDial{}, &CircuitOpenError{Addr: addr, Until: breaker.retryAt}
+		}
+		b.transition(breaker, circuitHalfOpen)
+	case circuitHalfOpen:
+		if breaker.trialInFlight {
+			return circuitDial{}, &CircuitOpenError{Addr: addr, Until: breaker.retryAt}
+		}
+	default:
+		breaker.dialsInFlight++
+		return circuitDial{breaker: breaker, generation: breaker.generation}, nil
+	}
+	breaker.trialInFlight = true
+	breaker.dialsInFlight++
+	return circuitDial{breaker: breaker, generation: breaker.generation, trial: true}, nil
+}
+
+// done accounts for the outcome of a dial let through by `allow`. Only the trial dial of a half-open breaker decides
+// its state, and dials let through before the last transition of the breaker are ignored, e.g. a slow dial started
+// before the breaker opened, which says nothing about whether the address recovered since.
+// The outcome is ignored as well once ctx is done, since the dial was cut short by the caller, e.g. by its deadline.
+func (b *circuitBreakers) done(ctx context.Context, dial circuitDial, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	breaker := dial.breaker
+	breaker.dialsInFlight--
+	if dial.trial {
+		breaker.trialInFlight = false
+	}
+	if dial.generation != breaker.generation || ctx.Err() != nil {
+		// A dial the caller gave up on says nothing about the address.
+		return
+	}
+	failed := err != nil
+	switch {
+	case dial.trial:
+		if failed {
+			b.open(breaker)
+		} else {
+			b.transition(breaker, circuitClosed)
+		}
+	case breaker.state == circuitClosed:
+		if time.Since(breaker.windowStart) > b.cfg.Window {
+			breaker.windowStart, breaker.dials, breaker.failures = time.Now(), 0, 0
+		}
+		breaker.dials++
+		if !failed {
+			breaker.consecutiveFailures = 0
+			return
+		}
+		breaker.failures++
+		breaker.consecutiveFailures++
+		if (b.cfg.ConsecutiveFailures > 0 && breaker.consecutiveFailures >= b.cfg.ConsecutiveFailures) ||
+			(b.cfg.FailureRatio > 0 && breaker.dials >= b.cfg.MinDials && float64(breaker.failures)/float64(breaker.dials) >= b.cfg.FailureRatio) {
+			b.open(breaker)
+		}
+	}
+}
+
+// sweep drops the breakers that weren't dialed for IdleTimeout, along with their trace and gauge series. Open and
+// half-open breakers are kept for IdleTimeout past the time they would let a trial dial through, so that a breaker
+// isn't dropped, and closed again, while its address is still expected to fail.
+func (b *circuitBreakers) sweep(now time.Time) {
+	for key, breaker := range b.byKey {
+		idleSince := breaker.lastDial
+		if breaker.state != circuitClosed && breaker.retryAt.After(idleSince) {
+			idleSince = breaker.retryAt
+		}
+		if breaker.dialsInFlight > 0 || now.Sub(idleSince) < b.cfg.IdleTimeout {
+			continue
+		}
+		delete(b.byKey, key)
+		if breaker.event != nil {
+			breaker.event.Finish()
+		}
+		if b.opts.monitoring {
+			b.opts.metrics.forgetDialerCircuitBreaker(key.name, key.addr)
+		}
+	}
+	b.lastSweep = now
+}
+
+func (b *circuitBreakers) open(breaker *circuitBreaker) {
+	breaker.retryAt = time.Now().Add(b.cfg.OpenFor)
+	b.transition(breaker, circuitOpen)
+}
+
+func (b *circuitBreakers) transition(breaker *circuitBreaker, state circuitState) {
+	if breaker.event != nil {
+		breaker.event.Printf("%s -> %s (%d of %d dials failed, %d in a row)", breaker.state, state, breaker.failures, breaker.dials, breaker.consecutiveFailures)
+	}
+	breaker.state = state
+	breaker.generation++
+	if state == circuitClosed {
+		breaker.consecutiveFailures, breaker.dials, breaker.failures, breaker.windowStart = 0, 0, 0, time.Now()
+	}
+	if b.opts.monitoring {
+		b.opts.metrics.reportDialerCircuitBreakerState(breaker.name, breaker.addr, state)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// closedLocal is a Close without a prior error, initiated by the owner of the connection.
+	closedLocal = "local"
+	// closedRemoteEOF is a Close after the peer closed its side of the connection.
+	closedRemoteEOF = "remote_eof"
+	// closedReset is a Close after the peer reset the connection.
+	closedReset = "reset"
+	// closedTimeout is a Close after a Read or Write deadline was exceeded.
+	closedTimeout = "timeout"
+	// closedForced is a Close initiated by conntrack on behalf of the operator, e.g. by `Drain` or `DebugHandler`.
+	closedForced = "forced"
+	closedIdle   = "idle"
+	closedMaxAge = "max_age"
+)
+
+// closeReasons are the reasons a connection of any listener or dialer can be closed for.
+var closeReasons = []string{closedLocal, closedRemoteEOF, closedReset, closedTimeout, closedForced, closedIdle}
+
+// closeWithReason closes the given tracked connection, accounting the close under the given reason unless the
+// connection is already being closed for another one.
+func (s *connStats) closeWithReason(conn net.Conn, reason string) {
+	s.closeReason.CompareAndSwap(nil, reason)
+	conn.Close()
+}
+
+// terminalError is the first terminal error returned by Read or Write.
+type terminalError struct {
+	err    error
+	reason string
+	at     time.Time
+}
+
+// recordError remembers the first terminal error returned by Read or Write, which explains a later Close. Exceeded
+// deadlines only count as long as no Read or Write succeeds after them, since they are also used to interrupt blocked
+// calls, e.g. by `net/http` after every request it serves.
+func (s *connStats) recordError(err error) {
+	recorded := s.terminalErr.Load()
+	if recorded != nil && !errors.Is(recorded.err, os.ErrDeadlineExceeded) {
+		return
+	}
+	if err == nil {
+		if recorded != nil {
+			s.terminalErr.CompareAndSwap(recorded, nil)
+		}
+		return
+	}
+	if reason := s.errorClassifier.terminalErrorReason(err); reason != "" {
+		s.terminalErr.CompareAndSwap(recorded, &terminalError{err: err, reason: reason, at: time.Now()})
+	}
+}
+
+// closedReason returns the reason the connection is closed for: the reason of whoever closed it on purpose, or else
+// the first terminal error, or else a local Close.
+func (s *connStats) closedReason() string {
+	if reason, ok := s.closeReason.Load().(string); ok {
+		return reason
+	}
+	if terminalErr := s.terminalErr.Load(); terminalErr != nil {
+		return terminalErr.reason
+	}
+	return closedLocal
+}
+
+// terminalErrorReason classifies the given Read or Write error into one of the close reasons. Errors caused by the
+// connection being closed already, or that can't be told apart, return an empty reason.
+func terminalErrorReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return closedRemoteEOF
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNABORTED):
+		return closedReset
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return closedTimeout
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestCloseTestSuite(t *testing.T) {
+	suite.Run(t, &CloseTestSuite{})
+}
+
+// CloseTestSuite makes sure that closing tracked connections is accounted for exactly once, however many times and
+// from however many goroutines they are closed.
+type CloseTestSuite struct {
+	suite.Suite
+
+	reg      *prometheus.Registry
+	listener conntrack.Listener
+	dialFunc func(context.Context, string, string) (net.Conn, error)
+}
+
+func (s *CloseTestSuite) SetupTest() {
+	s.reg = prometheus.NewRegistry()
+	metrics := conntrack.NewMetrics(s.reg)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(s.T(), err, "must be able to allocate a port")
+	s.listener = conntrack.NewListener(inner, conntrack.TrackWithName("close"), conntrack.TrackWithMetrics(metrics), conntrack.TrackWithTracing())
+	s.dialFunc = conntrack.NewDialContextFunc(conntrack.DialWithName("close"), conntrack.DialWithMetrics(metrics), conntrack.DialWithTracing())
+}
+
+func (s *CloseTestSuite) TearDownTest() {
+	s.listener.Close()
+}
+
+// connPair returns both ends of a connection tracked by the dialer and the listener.
+func (s *CloseTestSuite) connPair() (net.Conn, net.Conn) {
+	clientConn, err := s.dialFunc(context.TODO(), "tcp", s.listener.Addr().String())
+	require.NoError(s.T(), err, "dialing the listener must succeed")
+	serverConn, err := s.listener.Accept()
+	require.NoError(s.T(), err, "the connection must be accepted")
+	return clientConn, serverConn
+}
+
+func (s *CloseTestSuite) assertClosedOnce(kind string) {
+	assert.Equal(s.T(), 1, sumCountersForMetricAndLabelsFrom(s.T(), s.reg, "net_conntrack_"+kind+"_conn_closed_total", "close"),
+		"the %s connection must be counted as closed exactly once", kind)
+	assert.Equal(s.T(), 0, sumCountersForMetricAndLabelsFrom(s.T(), s.reg, "net_conntrack_"+kind+"_conn_open", "close"),
+		"the %s connection must not be counted as open", kind)
+	assert.Equal(s.T(), 1, sumCountersForMetricAndLabelsFrom(s.T(), s.reg, "net_conntrack_"+kind+"_conn_duration_seconds_count", "close"),
+		"the duration of the %s connection must be observed exactly once", kind)
+}
+
+func (s *CloseTestSuite) TestDoubleClose() {
+	clientConn, serverConn := s.connPair()
+
+	for _, conn := range []net.Conn{clientConn, serverConn} {
+		assert.NoError(s.T(), conn.Close(), "the first Close must succeed")
+		assert.ErrorIs(s.T(), conn.Close(), net.ErrClosed, "subsequent Close calls must report the connection as closed")
+	}
+	s.assertClosedOnce("dialer")
+	s.assertClosedOnce("listener")
+}
+
+func (s *CloseTestSuite) TestConcurrentClose() {
+	clientConn, serverConn := s.connPair()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, conn := range []net.Conn{clientConn, serverConn} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn.Close()
+			}()
+		}
+	}
+	wg.Wait()
+	s.assertClosedOnce("dialer")
+	s.assertClosedOnce("listener")
+}
+
+func (s *CloseTestSuite) TestCloseRacingRead() {
+	clientConn, serverConn := s.connPair()
+
+	readDone := make(chan error, 2)
+	for _, conn := range []net.Conn{clientConn, serverConn} {
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			readDone <- err
+		}()
+	}
+	serverConn.Close()
+	clientConn.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-readDone:
+			assert.Error(s.T(), err, "a pending Read must fail once the connection is closed")
+		case <-time.After(time.Second):
+			s.T().Fatal("a pending Read must return once the connection is closed")
+		}
+	}
+	s.assertClosedOnce("dialer")
+	s.assertClosedOnce("listener")
+}
+
+func (s *CloseTestSuite) TestCloseAfterHijack() {
+	hijacked := make(chan struct{})
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			defer close(hijacked)
+			conn, buf, err := resp.(http.Hijacker).Hijack()
+			if !assert.NoError(s.T(), err, "the connection must be hijacked") {
+				return
+			}
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			buf.Flush()
+			conn.Close()
+			conn.Close()
+		}),
+	}
+	go httpServer.Serve(s.listener)
+
+	clientConn, err := s.dialFunc(context.TODO(), "tcp", s.listener.Addr().String())
+	require.NoError(s.T(), err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.listener.Addr().String(), nil)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), req.Write(clientConn), "the request must be sent")
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), req)
+	require.NoError(s.T(), err, "the hijacked connection must respond")
+	resp.Body.Close()
+	<-hijacked
+	require.NoError(s.T(), httpServer.Close(), "the server must be closed")
+
+	s.assertClosedOnce("listener")
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Unwrap returns the connection wrapped by conntrack, as it was accepted by the inner listener or dialed by the
+// parent dialer. Connections that were not tracked are returned as they are.
+// Reads and writes on the returned connection are not accounted for, and skip the bytes the listener may have
+// buffered while reading a PROXY protocol header.
+func Unwrap(conn net.Conn) net.Conn {
+	for {
+		switch wrapper := conn.(type) {
+		case trackedConn:
+			conn = wrapper.innerConn()
+		case *proxyProtocolConn:
+			conn = wrapper.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+type closeWriter interface{ CloseWrite() error }
+
+type closeReader interface{ CloseRead() error }
+
+type keepAliveSetter interface{ SetKeepAlive(keepalive bool) error }
+
+// withOptionalInterfaces returns the given tracker along with the `CloseWrite`, `CloseRead`, `SetKeepAlive` and
+// `SyscallConn` methods its inner connection has, e.g. all of them for a `net.TCPConn`. Type assertions on the
+// returned connection then succeed exactly when they would on the inner one, so that callers checking for e.g.
+// `CloseWrite` still fall back to `Close` for connections that can't be half-closed.
+func withOptionalInterfaces(tracker trackedConn) net.Conn {
+	inner := Unwrap(tracker.innerConn())
+	cw, hasCloseWrite := inner.(closeWriter)
+	cr, hasCloseRead := inner.(closeReader)
+	ka, hasKeepAlive := inner.(keepAliveSetter)
+	sc, hasSyscallConn := inner.(syscall.Conn)
+	var has int
+	for i, ok := range []bool{hasCloseWrite, hasCloseRead, hasKeepAlive, hasSyscallConn} {
+		if ok {
+			has |= 1 << i
+		}
+	}
+	switch has {
+	case 0b0000:
+		return tracker
+	case 0b0001:
+		return struct {
+			trackedConn
+			closeWriter
+		}{tracker, cw}
+	case 0b0010:
+		return struct {
+			trackedConn
+			closeReader
+		}{tracker, cr}
+	case 0b0011:
+		return struct {
+			trackedConn
+			closeWriter
+			closeReader
+		}{tracker, cw, cr}
+	case 0b0100:
+		return struct {
+			trackedConn
+			keepAliveSetter
+		}{tracker, ka}
+	case 0b0101:
+		return struct {
+			trackedConn
+			closeWriter
+			keepAliveSetter
+		}{tracker, cw, ka}
+	case 0b0110:
+		return struct {
+			trackedConn
+			closeReader
+			keepAliveSetter
+		}{tracker, cr, ka}
+	case 0b0111:
+		return struct {
+			trackedConn
+			closeWriter
+			closeReader
+			keepAliveSetter
+		}{tracker, cw, cr, ka}
+	case 0b1000:
+		return struct {
+			trackedConn
+			syscall.Conn
+		}{tracker, sc}
+	case 0b1001:
+		return struct {
+			trackedConn
+			closeWriter
+			syscall.Conn
+		}{tracker, cw, sc}
+	case 0b1010:
+		return struct {
+			trackedConn
+			closeReader
+			syscall.Conn
+		}{tracker, cr, sc}
+	case 0b1011:
+		return struct {
+			trackedConn
+			closeWriter
+			closeReader
+			syscall.Conn
+		}{tracker, cw, cr, sc}
+	case 0b1100:
+		return struct {
+			trackedConn
+			keepAliveSetter
+			syscall.Conn
+		}{tracker, ka, sc}
+	case 0b1101:
+		return struct {
+			trackedConn
+			closeWriter
+			keepAliveSetter
+			syscall.Conn
+		}{tracker, cw, ka, sc}
+	case 0b1110:
+		return struct {
+			trackedConn
+			closeReader
+			keepAliveSetter
+			syscall.Conn
+		}{tracker, cr, ka, sc}
+	case 0b1111:
+		return struct {
+			trackedConn
+			closeWriter
+			closeReader
+			keepAliveSetter
+			syscall.Conn
+		}{tracker, cw, cr, ka, sc}
+	}
+	panic("unreachable")
+}
+
+// readFrom writes everything read from r to the inner connection of the tracker, accounting for the bytes written.
+// It goes through the `io.ReaderFrom` of the inner connection so that zero-copy transfers like splice and sendfile
+// still happen. If r is a tracked connection too, the bytes are read from its inner connection directly and
+// accounted for as read on it. Only the PROXY protocol layer is skipped on either side, so that nested trackers still
+// account for the transfer.
+func (s *connStats) readFrom(inner net.Conn, r io.Reader) (int64, error) {
+	s.transfers.Add(1)
+	defer s.transfers.Add(-1)
+	src := r
+	var srcStats *connStats
+	if tracked, ok := r.(trackedConn); ok {
+		srcStats = tracked.stats()
+		srcStats.transfers.Add(1)
+		defer srcStats.transfers.Add(-1)
+		src = spliceableConn(tracked)
+	}
+	dstConn := inner
+	if proxyConn, ok := inner.(*proxyProtocolConn); ok {
+		dstConn = proxyConn.Conn
+	}
+	var n int64
+	var err error
+	if dst, ok := dstConn.(io.ReaderFrom); ok {
+		n, err = dst.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{inner}, src)
+	}
+	// The source is never wrapped to tell its errors apart, since the standard library only splices from the types it
+	// knows. Errors are attributed by the operation that failed instead, and to neither side if it can't be told.
+	var readErr, writeErr error
+	switch failedOp(err) {
+	case "read":
+		readErr = err
+	case "write":
+		writeErr = err
+	}
+	s.onWrite(int(n), writeErr)
+	if srcStats != nil {
+		srcStats.onRead(int(n), readErr)
+	}
+	return n, err
+}
+
+// failedOp returns the operation, `read` or `write`, of the innermost `net.OpError` err wraps that has one of them.
+func failedOp(err error) string {
+	op := ""
+	for ; err != nil; err = errors.Unwrap(err) {
+		if opErr, ok := err.(*net.OpError); ok && (opErr.Op == "read" || opErr.Op == "write") {
+			op = opErr.Op
+		}
+	}
+	return op
+}
+
+// writeTo writes everything read from the inner connection of the tracker to w, accounting for the bytes read.
+// Transfers to another tracked connection are handed over to its `readFrom`, so that both ends get accounted for.
+func (s *connStats) writeTo(tracker trackedConn, inner net.Conn, w io.Writer) (int64, error) {
+	if dst, ok := w.(trackedConn); ok {
+		return dst.stats().readFrom(dst.innerConn(), tracker)
+	}
+	s.transfers.Add(1)
+	defer s.transfers.Add(-1)
+	var n int64
+	var err error
+	// Unlike for readFrom, the inner connection must not be unwrapped here since a PROXY protocol connection first
+	// serves the bytes it buffered past the header.
+	if src, ok := inner.(io.WriterTo); ok {
+		n, err = src.WriteTo(w)
+	} else {
+		n, err = io.Copy(w, struct{ io.Reader }{inner})
+	}
+	s.onRead(int(n), err)
+	return n, err
+}
+
+// spliceableConn returns the inner connection of the given tracker to read from, past its PROXY protocol layer unless
+// the listener still holds bytes it buffered past the header, which have to be read first.
+func spliceableConn(tracked trackedConn) io.Reader {
+	inner := tracked.innerConn()
+	if proxyConn, ok := inner.(*proxyProtocolConn); ok && len(proxyConn.pending) == 0 {
+		return proxyConn.Conn
+	}
+	return inner
+}
+
+// idleSince returns the time of the last Read or Write, or now if a transfer through `readFrom` or `writeTo` is
+// ongoing, since these account for the bytes only once they are done.
+func (s *connStats) idleSince() time.Time {
+	if s.transfers.Load() > 0 {
+		return time.Now()
+	}
+	return time.Unix(0, s.lastActivity.Load())
+}
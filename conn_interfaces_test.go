@@ -0,0 +1,309 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trackedConnPair returns both ends of a connection tracked by a dialer and a listener of the given name.
+func trackedConnPair(t *testing.T, listener net.Listener, name string) (net.Conn, net.Conn) {
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName(name), conntrack.DialWithMetrics(conntrack.NewMetrics(nil)))
+	clientConn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	t.Cleanup(func() { clientConn.Close() })
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	t.Cleanup(func() { serverConn.Close() })
+	return clientConn, serverConn
+}
+
+func newInterfacesListener(t *testing.T, name string) conntrack.Listener {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName(name), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestTrackedConnOptionalInterfaces(t *testing.T) {
+	listener := newInterfacesListener(t, "interfaces")
+	clientConn, serverConn := trackedConnPair(t, listener, "interfaces")
+
+	for _, conn := range []net.Conn{clientConn, serverConn} {
+		_, ok := conntrack.Unwrap(conn).(*net.TCPConn)
+		assert.True(t, ok, "Unwrap must return the inner TCP connection")
+		assert.NoError(t, conn.(interface{ SetKeepAlive(bool) error }).SetKeepAlive(true), "SetKeepAlive must be passed on")
+		rawConn, err := conn.(syscall.Conn).SyscallConn()
+		require.NoError(t, err, "SyscallConn must be passed on")
+		assert.NoError(t, rawConn.Control(func(fd uintptr) {}), "the raw connection must be usable")
+	}
+
+	// Half-close the server side, the client must still be able to respond.
+	_, err := serverConn.Write([]byte("ping"))
+	require.NoError(t, err, "writing must succeed")
+	require.NoError(t, serverConn.(interface{ CloseWrite() error }).CloseWrite(), "CloseWrite must be passed on")
+	received, err := io.ReadAll(clientConn)
+	require.NoError(t, err, "the client must read until the half-close")
+	assert.Equal(t, "ping", string(received))
+	_, err = clientConn.Write([]byte("pong"))
+	require.NoError(t, err, "the client must still be able to write")
+	require.NoError(t, clientConn.(interface{ CloseWrite() error }).CloseWrite(), "CloseWrite must be passed on")
+	received, err = io.ReadAll(serverConn)
+	require.NoError(t, err, "the server must read until the half-close")
+	assert.Equal(t, "pong", string(received))
+
+	conns := conntrack.Connections(conntrack.ConnFilter{Name: "interfaces"})
+	require.Len(t, conns, 2, "both ends of the connection must be registered")
+	assert.EqualValues(t, 4, conns[0].BytesRead, "the bytes read by the client must be counted")
+	assert.EqualValues(t, 4, conns[1].BytesRead, "the bytes read by the server must be counted")
+}
+
+func TestTrackedConnUnsupportedInterfaces(t *testing.T) {
+	pipeConn, otherConn := net.Pipe()
+	defer otherConn.Close()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("pipe"),
+		conntrack.DialWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.DialWithDialContextFunc(func(context.Context, string, string) (net.Conn, error) {
+			return pipeConn, nil
+		}))
+	conn, err := dialFunc(context.TODO(), "pipe", "pipe")
+	require.NoError(t, err, "dialing must succeed")
+	defer conn.Close()
+
+	assert.Equal(t, pipeConn, conntrack.Unwrap(conn), "Unwrap must return the dialed connection")
+	_, ok := conn.(interface{ CloseWrite() error })
+	assert.False(t, ok, "CloseWrite must not be exposed when the dialed connection lacks it")
+	_, ok = conn.(interface{ CloseRead() error })
+	assert.False(t, ok, "CloseRead must not be exposed when the dialed connection lacks it")
+	_, ok = conn.(interface{ SetKeepAlive(bool) error })
+	assert.False(t, ok, "SetKeepAlive must not be exposed when the dialed connection lacks it")
+	_, ok = conn.(syscall.Conn)
+	assert.False(t, ok, "SyscallConn must not be exposed when the dialed connection lacks it")
+
+	go func() {
+		otherConn.Write([]byte("ping"))
+		otherConn.Close()
+	}()
+	var received bytes.Buffer
+	n, err := io.Copy(&received, conn)
+	require.NoError(t, err, "copying from a connection without WriteTo must succeed")
+	assert.EqualValues(t, 4, n)
+	assert.Equal(t, "ping", received.String())
+	assert.EqualValues(t, 4, conntrack.Connections(conntrack.ConnFilter{Name: "pipe"})[0].BytesRead,
+		"the bytes copied must be counted")
+}
+
+func TestTrackedConnPartialInterfaces(t *testing.T) {
+	inner, err := net.Listen("unix", t.TempDir()+"/conntrack.sock")
+	require.NoError(t, err, "must be able to listen on a unix socket")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("unix"), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	defer listener.Close()
+	clientConn, err := net.Dial("unix", inner.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer conn.Close()
+
+	_, ok := conn.(interface{ CloseWrite() error })
+	assert.True(t, ok, "CloseWrite of the unix connection must be exposed")
+	_, ok = conn.(syscall.Conn)
+	assert.True(t, ok, "SyscallConn of the unix connection must be exposed")
+	_, ok = conn.(interface{ SetKeepAlive(bool) error })
+	assert.False(t, ok, "SetKeepAlive must not be exposed for a unix connection")
+}
+
+func TestTrackedConnCopyBetweenTrackedConns(t *testing.T) {
+	listener := newInterfacesListener(t, "copy")
+	upstreamClient, upstreamServer := trackedConnPair(t, listener, "copy_upstream")
+	downstreamClient, downstreamServer := trackedConnPair(t, listener, "copy_downstream")
+
+	payload := bytes.Repeat([]byte("conntrack"), 100000)
+	go func() {
+		upstreamClient.Write(payload)
+		upstreamClient.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	copied := make(chan int64)
+	go func() {
+		n, _ := io.Copy(downstreamServer, upstreamServer)
+		downstreamServer.(interface{ CloseWrite() error }).CloseWrite()
+		copied <- n
+	}()
+	received, err := io.ReadAll(downstreamClient)
+	require.NoError(t, err, "the proxied data must be received")
+	assert.Equal(t, payload, received, "the proxied data must not be altered")
+	assert.EqualValues(t, len(payload), <-copied)
+
+	upstream := conntrack.Connections(conntrack.ConnFilter{Kind: conntrack.ConnKindListener, RemoteAddr: upstreamClient.LocalAddr().String()})
+	require.Len(t, upstream, 1)
+	assert.EqualValues(t, len(payload), upstream[0].BytesRead, "the bytes copied must be counted as read from the source")
+	downstream := conntrack.Connections(conntrack.ConnFilter{Kind: conntrack.ConnKindListener, RemoteAddr: downstreamClient.LocalAddr().String()})
+	require.Len(t, downstream, 1)
+	assert.EqualValues(t, len(payload), downstream[0].BytesWritten, "the bytes copied must be counted as written to the destination")
+}
+
+func TestTrackedConnCopyKeepsProxyProtocolPayload(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("copy_proxy"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{TrustedUpstreams: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	// Send the payload along with the header, so that the listener buffers it while reading the header.
+	_, err = clientConn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\npayload"))
+	require.NoError(t, err, "writing must succeed")
+	require.NoError(t, clientConn.(*net.TCPConn).CloseWrite())
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	var received bytes.Buffer
+	_, err = io.Copy(&received, conn)
+	require.NoError(t, err, "copying must succeed")
+	assert.Equal(t, "payload", received.String(), "the bytes buffered past the header must be copied first")
+}
+
+func TestTrackedConnCopyThroughNestedTrackers(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(
+		conntrack.NewListener(inner, conntrack.TrackWithName("copy_nested_inner"), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil))),
+		conntrack.TrackWithName("copy_nested_outer"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer conn.Close()
+
+	payload := bytes.Repeat([]byte("conntrack"), 1000)
+	go io.Copy(io.Discard, clientConn)
+	n, err := io.Copy(conn, struct{ io.Reader }{bytes.NewReader(payload)})
+	require.NoError(t, err, "copying must succeed")
+	assert.EqualValues(t, len(payload), n)
+	for _, name := range []string{"copy_nested_inner", "copy_nested_outer"} {
+		conns := conntrack.Connections(conntrack.ConnFilter{Name: name})
+		require.Len(t, conns, 1)
+		assert.EqualValues(t, len(payload), conns[0].BytesWritten, "the bytes copied must be counted by every tracker")
+	}
+}
+
+// resetReader fails like a source connection reset by its peer.
+type resetReader struct{}
+
+func (resetReader) Read([]byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+}
+
+func TestTrackedConnCopySourceErrorKeepsCloseReason(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("copy_source_error"), conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)))
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+
+	_, err = io.Copy(conn, resetReader{})
+	require.ErrorIs(t, err, syscall.ECONNRESET, "the error of the source must be returned")
+	conn.Close()
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "copy_source_error", "local"),
+		"a reset of the source must not be taken for one of the destination")
+}
+
+// spliceRecordingConn records whether the sources handed to its ReadFrom are still ones the standard library can
+// splice from, i.e. that they weren't wrapped on the way.
+type spliceRecordingConn struct {
+	*net.TCPConn
+	wrappedSources atomic.Int32
+}
+
+func (c *spliceRecordingConn) ReadFrom(r io.Reader) (int64, error) {
+	if _, ok := r.(syscall.Conn); !ok {
+		c.wrappedSources.Add(1)
+	}
+	return c.TCPConn.ReadFrom(r)
+}
+
+type spliceRecordingListener struct {
+	net.Listener
+	conns chan *spliceRecordingConn
+}
+
+func (l *spliceRecordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	recording := &spliceRecordingConn{TCPConn: conn.(*net.TCPConn)}
+	l.conns <- recording
+	return recording, nil
+}
+
+func TestTrackedConnCopyFromRawTCPConnKeepsSplice(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	recording := &spliceRecordingListener{Listener: inner, conns: make(chan *spliceRecordingConn, 2)}
+	listener := conntrack.NewListener(recording, conntrack.TrackWithName("copy_splice"), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	defer listener.Close()
+	source, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	defer source.Close()
+
+	dstClient, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer dstClient.Close()
+	dst, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer dst.Close()
+	srcClient, err := net.Dial("tcp", source.Addr().String())
+	require.NoError(t, err, "dialing the source must succeed")
+	defer srcClient.Close()
+	src, err := source.Accept()
+	require.NoError(t, err, "the source connection must be accepted")
+	defer src.Close()
+
+	payload := bytes.Repeat([]byte("conntrack"), 100000)
+	go func() {
+		srcClient.Write(payload)
+		srcClient.Close()
+	}()
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(dstClient)
+		received <- data
+	}()
+	n, err := io.Copy(dst, src.(*net.TCPConn))
+	require.NoError(t, err, "copying must succeed")
+	dst.(interface{ CloseWrite() error }).CloseWrite()
+	assert.EqualValues(t, len(payload), n)
+	assert.Equal(t, payload, <-received, "the copied data must not be altered")
+	assert.Zero(t, (<-recording.conns).wrappedSources.Load(), "the raw TCP source must be handed over unwrapped, so that it can be spliced")
+}
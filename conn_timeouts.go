@@ -0,0 +1,83 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"math"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// watchIdle closes the given tracked connection once no Read or Write happened on it for the given timeout. The
+// timer only looks at the last activity when it fires, so that Read and Write don't have to reset it.
+func (s *connStats) watchIdle(conn net.Conn, timeout time.Duration) {
+	s.timersMu.Lock()
+	defer s.timersMu.Unlock()
+	if s.closed.Load() {
+		return
+	}
+	s.idleTimer = time.AfterFunc(math.MaxInt64, func() {
+		if s.closed.Load() {
+			return
+		}
+		idle := time.Since(s.idleSince())
+		if idle < timeout {
+			s.resetTimer(s.idleTimer, timeout-idle)
+			return
+		}
+		s.closeWithReason(conn, closedIdle)
+	})
+	s.idleTimer.Reset(timeout)
+}
+
+// watchMaxAge closes the given tracked connection once it is older than maxAge plus a random duration of up to
+// jitter, so that connections opened at the same time are not all closed at once. If idleFor is set, the connection
+// is only closed once it has gone that long without a Read or Write past its max age.
+func (s *connStats) watchMaxAge(conn net.Conn, maxAge time.Duration, jitter time.Duration, idleFor time.Duration) {
+	if jitter > 0 {
+		maxAge += rand.N(jitter)
+	}
+	s.timersMu.Lock()
+	defer s.timersMu.Unlock()
+	if s.closed.Load() {
+		return
+	}
+	s.maxAgeTimer = time.AfterFunc(math.MaxInt64, func() {
+		if s.closed.Load() {
+			return
+		}
+		if idleFor > 0 {
+			idle := time.Since(s.idleSince())
+			if idle < idleFor {
+				s.resetTimer(s.maxAgeTimer, idleFor-idle)
+				return
+			}
+		}
+		s.closeWithReason(conn, closedMaxAge)
+	})
+	s.maxAgeTimer.Reset(maxAge - time.Since(s.openedAt))
+}
+
+// resetTimer re-arms the given timer from its own callback, unless the connection got closed in the meantime.
+func (s *connStats) resetTimer(timer *time.Timer, d time.Duration) {
+	s.timersMu.Lock()
+	defer s.timersMu.Unlock()
+	if !s.closed.Load() {
+		timer.Reset(d)
+	}
+}
+
+// stopTimers stops the timers closing the connection, once it is closed. Since `closed` is set by then, timers can't
+// be started or re-armed afterwards.
+func (s *connStats) stopTimers() {
+	s.timersMu.Lock()
+	defer s.timersMu.Unlock()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	if s.maxAgeTimer != nil {
+		s.maxAgeTimer.Stop()
+	}
+}
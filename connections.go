@@ -0,0 +1,229 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnKind tells whether a tracked connection was accepted by a listener or established by a dialer.
+type ConnKind string
+
+const (
+	ConnKindListener ConnKind = "listener"
+	ConnKindDialer   ConnKind = "dialer"
+)
+
+// ConnInfo is a snapshot of the state of a tracked connection, see `Connections`.
+type ConnInfo struct {
+	ID           uint64    `json:"id"`
+	Kind         ConnKind  `json:"kind"`
+	Name         string    `json:"name"`
+	LocalAddr    string    `json:"local_addr"`
+	RemoteAddr   string    `json:"remote_addr"`
+	StartTime    time.Time `json:"start_time"`
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// ConnFilter selects the connections returned by `Connections`. Zero value fields match all connections.
+type ConnFilter struct {
+	// Kind matches connections of the given kind.
+	Kind ConnKind
+	// Name matches connections of the listener or dialer of the given name.
+	Name string
+	// RemoteAddr matches connections whose remote address contains the given string, e.g. an IP.
+	RemoteAddr string
+}
+
+// Connections returns a snapshot of the open connections tracked by all listeners and dialers that match the given
+// filter, ordered by their ID, which is the order they were opened in.
+func Connections(filter ConnFilter) []ConnInfo {
+	return registry.connections(filter)
+}
+
+// trackedConn is a connection tracked by a listener or a dialer.
+type trackedConn interface {
+	net.Conn
+	io.ReaderFrom
+	io.WriterTo
+	stats() *connStats
+	// innerConn returns the connection wrapped by the tracker.
+	innerConn() net.Conn
+}
+
+// registry holds all open tracked connections.
+var registry = newConnRegistry()
+
+type connRegistryKey struct {
+	kind ConnKind
+	name string
+}
+
+// connRegistry is an index of tracked connections by their ID as well as their kind and name.
+type connRegistry struct {
+	nextID atomic.Uint64
+
+	mu     sync.RWMutex
+	byID   map[uint64]trackedConn
+	byName map[connRegistryKey]map[uint64]trackedConn
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		byID:   make(map[uint64]trackedConn),
+		byName: make(map[connRegistryKey]map[uint64]trackedConn),
+	}
+}
+
+func (r *connRegistry) register(conn trackedConn) {
+	stats := conn.stats()
+	key := connRegistryKey{kind: stats.kind, name: stats.name}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byID[stats.id] = conn
+	if r.byName[key] == nil {
+		r.byName[key] = make(map[uint64]trackedConn)
+	}
+	r.byName[key][stats.id] = conn
+}
+
+func (r *connRegistry) unregister(conn trackedConn) {
+	stats := conn.stats()
+	key := connRegistryKey{kind: stats.kind, name: stats.name}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byID, stats.id)
+	delete(r.byName[key], stats.id)
+	if len(r.byName[key]) == 0 {
+		delete(r.byName, key)
+	}
+}
+
+// closeConn closes the connection of the given ID, returning false if there is no such open connection.
+func (r *connRegistry) closeConn(id uint64) bool {
+	r.mu.RLock()
+	conn, ok := r.byID[id]
+	r.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	conn.stats().closeWithReason(conn, closedForced)
+	return true
+}
+
+func (r *connRegistry) connections(filter ConnFilter) []ConnInfo {
+	r.mu.RLock()
+	var conns []trackedConn
+	for key, named := range r.byName {
+		if (filter.Kind != "" && filter.Kind != key.kind) || (filter.Name != "" && filter.Name != key.name) {
+			continue
+		}
+		for _, conn := range named {
+			conns = append(conns, conn)
+		}
+	}
+	r.mu.RUnlock()
+
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		info := conn.stats().info(conn)
+		if filter.RemoteAddr != "" && !strings.Contains(info.RemoteAddr, filter.RemoteAddr) {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b ConnInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// connStats is the live state of a tracked connection, shared by the listener and the dialer trackers.
+type connStats struct {
+	id       uint64
+	kind     ConnKind
+	name     string
+	openedAt time.Time
+
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	// lastActivity is the time of the last Read or Write in Unix nanoseconds.
+	lastActivity atomic.Int64
+	// transfers is the number of ongoing `readFrom` and `writeTo` calls.
+	transfers atomic.Int32
+
+	// observers are notified of the connection, passing them observerCtx, see `ConnObserver`.
+	observers   []ConnObserver
+	observerCtx context.Context
+	observed    ObservedConn
+	// transferObservers are the observers notified of Reads and Writes, leaving out the Prometheus ones.
+	transferObservers []ConnObserver
+	// prometheus holds the collectors of the connection for each Prometheus observer, set when it's accepted or dialed
+	// so that Reads and Writes are counted without going through the observers.
+	prometheus []*prometheusConn
+	// errorClassifier classifies Read and Write errors into close reasons, if the listener or dialer has one.
+	errorClassifier *errorClassifier
+
+	// closed is set by the first Close, which is the only one accounting for the connection being closed.
+	closed atomic.Bool
+
+	// closeReason is the reason the connection is closed for, set by whoever closes it first, see `closeWithReason`.
+	closeReason atomic.Value
+	terminalErr atomic.Pointer[terminalError]
+
+	// timersMu guards the timers closing the connection, which are started and stopped concurrently to each other
+	// and to their own callbacks.
+	timersMu    sync.Mutex
+	idleTimer   *time.Timer
+	maxAgeTimer *time.Timer
+}
+
+func (s *connStats) init(conn net.Conn, kind ConnKind, name string) {
+	s.id = registry.nextID.Add(1)
+	s.kind = kind
+	s.name = name
+	s.openedAt = time.Now()
+	s.lastActivity.Store(s.openedAt.UnixNano())
+	s.observed = ObservedConn{ID: s.id, Kind: kind, Name: name, Conn: conn, OpenedAt: s.openedAt, stats: s}
+}
+
+func (s *connStats) countRead(n int) {
+	if n <= 0 {
+		return
+	}
+	s.lastActivity.Store(time.Now().UnixNano())
+	s.bytesRead.Add(uint64(n))
+}
+
+func (s *connStats) countWritten(n int) {
+	if n <= 0 {
+		return
+	}
+	s.lastActivity.Store(time.Now().UnixNano())
+	s.bytesWritten.Add(uint64(n))
+}
+
+func (s *connStats) info(conn net.Conn) ConnInfo {
+	return ConnInfo{
+		ID:           s.id,
+		Kind:         s.kind,
+		Name:         s.name,
+		LocalAddr:    conn.LocalAddr().String(),
+		RemoteAddr:   conn.RemoteAddr().String(),
+		StartTime:    s.openedAt,
+		BytesRead:    s.bytesRead.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+		LastActivity: time.Unix(0, s.lastActivity.Load()),
+	}
+}
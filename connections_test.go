@@ -0,0 +1,58 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionsRegistry(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("registry"), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	defer listener.Close()
+
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("registry"), conntrack.DialWithMetrics(conntrack.NewMetrics(nil)))
+	clientConn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer serverConn.Close()
+
+	_, err = clientConn.Write([]byte("ping"))
+	require.NoError(t, err, "writing must succeed")
+	_, err = io.ReadFull(serverConn, make([]byte, 4))
+	require.NoError(t, err, "reading must succeed")
+
+	conns := conntrack.Connections(conntrack.ConnFilter{Name: "registry"})
+	require.Len(t, conns, 2, "both ends of the connection must be registered")
+	dialed, accepted := conns[0], conns[1]
+	assert.Equal(t, conntrack.ConnKindDialer, dialed.Kind, "the dialed connection must have been opened first")
+	assert.Equal(t, conntrack.ConnKindListener, accepted.Kind, "the accepted connection must have been opened last")
+	assert.Less(t, dialed.ID, accepted.ID, "connections must be ordered by their ID")
+	assert.Equal(t, clientConn.LocalAddr().String(), accepted.RemoteAddr, "the remote address must be reported")
+	assert.Equal(t, clientConn.LocalAddr().String(), dialed.LocalAddr, "the local address must be reported")
+	assert.EqualValues(t, 4, dialed.BytesWritten, "the bytes written must be reported")
+	assert.EqualValues(t, 4, accepted.BytesRead, "the bytes read must be reported")
+	assert.WithinDuration(t, time.Now(), accepted.LastActivity, time.Second, "the last activity must be reported")
+	assert.False(t, accepted.StartTime.After(accepted.LastActivity), "the last activity can't be before the start")
+
+	assert.Len(t, conntrack.Connections(conntrack.ConnFilter{Kind: conntrack.ConnKindListener, Name: "registry"}), 1,
+		"connections must be filtered by kind")
+	assert.Len(t, conntrack.Connections(conntrack.ConnFilter{Name: "registry", RemoteAddr: listener.Addr().String()}), 1,
+		"connections must be filtered by remote address")
+
+	serverConn.Close()
+	clientConn.Close()
+	assert.Empty(t, conntrack.Connections(conntrack.ConnFilter{Name: "registry"}), "closed connections must be unregistered")
+}
@@ -0,0 +1,233 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	debugSortAge   = "age"
+	debugSortBytes = "bytes"
+)
+
+type debugOpts struct {
+	authorizeClose func(*http.Request) bool
+}
+
+// DebugOpt defines a config option you can set on the debug handler.
+type DebugOpt func(*debugOpts)
+
+// DebugWithCloseAuthorizer enables closing connections by their ID from the debug handler, for the requests the given
+// func authorizes. Closing is disabled by default.
+func DebugWithCloseAuthorizer(authorize func(*http.Request) bool) DebugOpt {
+	return func(opts *debugOpts) {
+		opts.authorizeClose = authorize
+	}
+}
+
+// DebugHandler returns a handler listing the open connections of all listeners and dialers, grouped by their name.
+// It renders HTML, or JSON if requested with `format=json` or an `Accept: application/json` header.
+// The list can be narrowed down with the `kind`, `name` and `remote` (substring of the remote address) query
+// parameters, and ordered with `sort=age` (oldest first, the default) or `sort=bytes` (busiest first).
+//
+// If enabled with `DebugWithCloseAuthorizer`, a POST request with an `id` form value closes that connection. To protect
+// against cross-site request forgery, the request must either come from the form of the HTML page, which carries a
+// token, or have an `X-Requested-With` header, which browsers don't let other sites set. DebugHandler panics if the
+// token can't be generated.
+func DebugHandler(optFuncs ...DebugOpt) http.Handler {
+	opts := &debugOpts{}
+	for _, f := range optFuncs {
+		f(opts)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		// A predictable token would defeat the protection of the close action.
+		panic(fmt.Sprintf("conntrack: failed generating the debug handler token: %v", err))
+	}
+	return &debugHandler{opts: opts, closeToken: hex.EncodeToString(token)}
+}
+
+type debugHandler struct {
+	opts *debugOpts
+	// closeToken is put in the close forms of the HTML page, so that only the page itself can submit them.
+	closeToken string
+}
+
+// debugConnGroup is the open connections of a single listener or dialer name.
+type debugConnGroup struct {
+	Kind        ConnKind   `json:"kind"`
+	Name        string     `json:"name"`
+	Connections []ConnInfo `json:"connections"`
+}
+
+func (h *debugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		h.serveList(w, req)
+	case http.MethodPost:
+		h.serveClose(w, req)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *debugHandler) serveList(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := ConnFilter{
+		Kind:       ConnKind(query.Get("kind")),
+		Name:       query.Get("name"),
+		RemoteAddr: query.Get("remote"),
+	}
+	sortBy := query.Get("sort")
+	if sortBy != debugSortBytes {
+		sortBy = debugSortAge
+	}
+	groups := groupConnections(Connections(filter), sortBy)
+
+	if query.Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(groups); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	data := struct {
+		Groups   []debugConnGroup
+		Filter   ConnFilter
+		Sort     string
+		CanClose bool
+		Token    string
+		Now      time.Time
+	}{
+		Groups:   groups,
+		Filter:   filter,
+		Sort:     sortBy,
+		CanClose: h.opts.authorizeClose != nil && h.opts.authorizeClose(req),
+		Token:    h.closeToken,
+		Now:      time.Now(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugPageTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *debugHandler) serveClose(w http.ResponseWriter, req *http.Request) {
+	if h.opts.authorizeClose == nil || !h.opts.authorizeClose(req) {
+		http.Error(w, "closing connections is not allowed", http.StatusForbidden)
+		return
+	}
+	if req.Header.Get("X-Requested-With") == "" &&
+		subtle.ConstantTimeCompare([]byte(req.FormValue("token")), []byte(h.closeToken)) != 1 {
+		http.Error(w, "missing or invalid token", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if !registry.closeConn(id) {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, req, req.URL.Path+"?"+req.URL.RawQuery, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func groupConnections(conns []ConnInfo, sortBy string) []debugConnGroup {
+	var groups []debugConnGroup
+	index := make(map[connRegistryKey]int)
+	for _, conn := range conns {
+		key := connRegistryKey{kind: conn.Kind, name: conn.Name}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, debugConnGroup{Kind: conn.Kind, Name: conn.Name})
+		}
+		groups[i].Connections = append(groups[i].Connections, conn)
+	}
+	slices.SortFunc(groups, func(a, b debugConnGroup) int {
+		return cmp.Or(cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Name, b.Name))
+	})
+	// Connections are ordered by their ID already, which is the oldest first.
+	if sortBy == debugSortBytes {
+		for _, group := range groups {
+			slices.SortStableFunc(group.Connections, func(a, b ConnInfo) int {
+				return cmp.Compare(b.BytesRead+b.BytesWritten, a.BytesRead+a.BytesWritten)
+			})
+		}
+	}
+	return groups
+}
+
+var debugPageTemplate = template.Must(template.New("conntrack").Funcs(template.FuncMap{
+	"age": func(now time.Time, t time.Time) time.Duration {
+		return now.Sub(t).Round(time.Millisecond)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>conntrack: open connections</title>
+	<style type="text/css">
+		body { font-family: sans-serif; }
+		table { border-collapse: collapse; margin-bottom: 2em; }
+		th, td { padding: 0.2em 1em; text-align: left; }
+		td { font-family: monospace; }
+		tr:nth-child(even) { background: #eee; }
+	</style>
+</head>
+<body>
+<h1>Open connections</h1>
+<form method="get">
+	<input type="hidden" name="kind" value="{{.Filter.Kind}}">
+	<input type="hidden" name="name" value="{{.Filter.Name}}">
+	Remote address: <input type="text" name="remote" value="{{.Filter.RemoteAddr}}">
+	Sort by: <select name="sort">
+		<option value="age"{{if eq .Sort "age"}} selected{{end}}>age</option>
+		<option value="bytes"{{if eq .Sort "bytes"}} selected{{end}}>bytes</option>
+	</select>
+	<input type="submit" value="Filter">
+</form>
+{{$now := .Now}}{{$canClose := .CanClose}}{{$token := .Token}}
+{{range .Groups}}
+<h2>{{.Kind}} {{.Name}} ({{len .Connections}})</h2>
+<table>
+	<tr><th>ID</th><th>Local</th><th>Remote</th><th>Age</th><th>Idle</th><th>Read</th><th>Written</th>{{if $canClose}}<th></th>{{end}}</tr>
+	{{range .Connections}}
+	<tr>
+		<td>{{.ID}}</td>
+		<td>{{.LocalAddr}}</td>
+		<td>{{.RemoteAddr}}</td>
+		<td>{{age $now .StartTime}}</td>
+		<td>{{age $now .LastActivity}}</td>
+		<td>{{.BytesRead}}</td>
+		<td>{{.BytesWritten}}</td>
+		{{if $canClose}}<td><form method="post"><input type="hidden" name="id" value="{{.ID}}"><input type="hidden" name="token" value="{{$token}}"><input type="submit" value="Close"></form></td>{{end}}
+	</tr>
+	{{end}}
+</table>
+{{else}}
+<p>No open connections.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,147 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type debugConnGroup struct {
+	Kind        conntrack.ConnKind   `json:"kind"`
+	Name        string               `json:"name"`
+	Connections []conntrack.ConnInfo `json:"connections"`
+}
+
+func TestDebugHandler(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("debug"), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	defer listener.Close()
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("debug"), conntrack.DialWithMetrics(conntrack.NewMetrics(nil)))
+
+	var serverConns []net.Conn
+	for i := 0; i < 2; i++ {
+		clientConn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+		require.NoError(t, err, "dialing the listener must succeed")
+		defer clientConn.Close()
+		serverConn, err := listener.Accept()
+		require.NoError(t, err, "the connection must be accepted")
+		defer serverConn.Close()
+		serverConns = append(serverConns, serverConn)
+	}
+	// Make the newest accepted connection the busiest one.
+	_, err = serverConns[1].Write([]byte("ping"))
+	require.NoError(t, err, "writing must succeed")
+
+	list := func(t *testing.T, handler http.Handler, query string) []debugConnGroup {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/conns?format=json&name=debug&"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, "listing must succeed")
+		var groups []debugConnGroup
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &groups), "the listing must be valid JSON")
+		return groups
+	}
+
+	t.Run("JSON listing grouped by kind and name", func(t *testing.T) {
+		groups := list(t, conntrack.DebugHandler(), "")
+		require.Len(t, groups, 2, "the dialer and the listener must be listed separately")
+		assert.Equal(t, conntrack.ConnKindDialer, groups[0].Kind, "groups must be sorted by kind")
+		assert.Equal(t, conntrack.ConnKindListener, groups[1].Kind, "groups must be sorted by kind")
+		require.Len(t, groups[1].Connections, 2, "both accepted connections must be listed")
+		assert.Less(t, groups[1].Connections[0].ID, groups[1].Connections[1].ID, "the oldest connection must be first by default")
+	})
+
+	t.Run("sort by bytes", func(t *testing.T) {
+		groups := list(t, conntrack.DebugHandler(), "kind=listener&sort=bytes")
+		require.Len(t, groups, 1, "connections must be filtered by kind")
+		require.Len(t, groups[0].Connections, 2, "both accepted connections must be listed")
+		assert.EqualValues(t, 4, groups[0].Connections[0].BytesWritten, "the busiest connection must be first")
+	})
+
+	t.Run("filter by remote address", func(t *testing.T) {
+		groups := list(t, conntrack.DebugHandler(), "kind=listener&remote="+url.QueryEscape(serverConns[0].RemoteAddr().String()))
+		require.Len(t, groups, 1, "the listener group must be listed")
+		require.Len(t, groups[0].Connections, 1, "connections must be filtered by remote address")
+		assert.Equal(t, serverConns[0].RemoteAddr().String(), groups[0].Connections[0].RemoteAddr)
+	})
+
+	t.Run("HTML listing", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		conntrack.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/conns?name=debug", nil))
+		require.Equal(t, http.StatusOK, rec.Code, "listing must succeed")
+		assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+		assert.Contains(t, rec.Body.String(), serverConns[0].RemoteAddr().String(), "connections must be listed")
+		assert.NotContains(t, rec.Body.String(), `value="Close"`, "closing must not be offered without an authorizer")
+	})
+
+	closeConn := func(handler http.Handler, id uint64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/debug/conns", strings.NewReader(url.Values{"id": {strconv.FormatUint(id, 10)}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Requested-With", "test")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	accepted := conntrack.Connections(conntrack.ConnFilter{Kind: conntrack.ConnKindListener, Name: "debug"})
+	require.Len(t, accepted, 2, "both accepted connections must be registered")
+
+	t.Run("close forbidden by default", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, closeConn(conntrack.DebugHandler(), accepted[0].ID).Code)
+		denied := conntrack.DebugHandler(conntrack.DebugWithCloseAuthorizer(func(*http.Request) bool { return false }))
+		assert.Equal(t, http.StatusForbidden, closeConn(denied, accepted[0].ID).Code)
+		assert.Len(t, conntrack.Connections(conntrack.ConnFilter{Kind: conntrack.ConnKindListener, Name: "debug"}), 2,
+			"no connection must be closed")
+	})
+
+	t.Run("close requires a token or a custom header", func(t *testing.T) {
+		handler := conntrack.DebugHandler(conntrack.DebugWithCloseAuthorizer(func(*http.Request) bool { return true }))
+		postForm := func(values url.Values) int {
+			req := httptest.NewRequest(http.MethodPost, "/debug/conns", strings.NewReader(values.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		id := strconv.FormatUint(accepted[1].ID, 10)
+		assert.Equal(t, http.StatusForbidden, postForm(url.Values{"id": {id}}), "a plain form post must be refused")
+		assert.Equal(t, http.StatusForbidden, postForm(url.Values{"id": {id}, "token": {"forged"}}), "a forged token must be refused")
+		assert.Len(t, conntrack.Connections(conntrack.ConnFilter{Kind: conntrack.ConnKindListener, Name: "debug"}), 2,
+			"no connection must be closed")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/conns?name=debug", nil))
+		token := regexp.MustCompile(`name="token" value="([0-9a-f]+)"`).FindStringSubmatch(rec.Body.String())
+		require.Len(t, token, 2, "the close forms of the page must carry the token")
+		assert.Equal(t, http.StatusNotFound, postForm(url.Values{"id": {"0"}, "token": {token[1]}}),
+			"the form of the page must be accepted")
+	})
+
+	t.Run("close by ID", func(t *testing.T) {
+		handler := conntrack.DebugHandler(conntrack.DebugWithCloseAuthorizer(func(*http.Request) bool { return true }))
+		assert.Equal(t, http.StatusNoContent, closeConn(handler, accepted[0].ID).Code)
+		remaining := conntrack.Connections(conntrack.ConnFilter{Kind: conntrack.ConnKindListener, Name: "debug"})
+		require.Len(t, remaining, 1, "the connection must be closed")
+		assert.Equal(t, accepted[1].ID, remaining[0].ID, "only the given connection must be closed")
+		_, err := serverConns[0].Read(make([]byte, 1))
+		assert.ErrorIs(t, err, net.ErrClosed, "the connection must be closed")
+		assert.Equal(t, http.StatusNotFound, closeConn(handler, accepted[0].ID).Code, "closed connections must not be found")
+	})
+
+	rec := httptest.NewRecorder()
+	conntrack.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/debug/conns", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
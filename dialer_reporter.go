@@ -5,109 +5,287 @@ package conntrack
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-type failureReason string
+// The reasons dials fail for, as reported by the `reason` label of `dialer_conn_failed_total`, see `DialFailureReason`.
+const (
+	DialFailedResolution  = "resolution"
+	DialFailedRefused     = "refused"
+	DialFailedTimeout     = "timeout"
+	DialFailedCanceled    = "canceled"
+	DialFailedReset       = "reset"
+	DialFailedUnreachable = "unreachable"
+	DialFailedTLS         = "tls"
+	DialFailedProxy       = "proxy"
+	DialFailedAddrInUse   = "addr_in_use"
+	// DialFailedCircuitOpen is a dial failed fast by an open circuit breaker, see `DialWithCircuitBreaker`.
+	DialFailedCircuitOpen = "circuit_open"
+	DialFailedUnknown     = "unknown"
+)
+
+// dialFailureReasons are the reasons a dial can fail for.
+var dialFailureReasons = []string{
+	DialFailedResolution, DialFailedRefused, DialFailedTimeout, DialFailedCanceled, DialFailedReset,
+	DialFailedUnreachable, DialFailedTLS, DialFailedProxy, DialFailedAddrInUse, DialFailedCircuitOpen, DialFailedUnknown,
+}
 
 const (
-	failedResolution  = "resolution"
-	failedConnRefused = "refused"
-	failedTimeout     = "timeout"
-	failedUnknown     = "unknown"
+	dialOutcomeSuccess = "success"
 )
 
-var (
-	dialerAttemptedTotal = promauto.NewCounterVec(
+func (m *Metrics) initDialerMetrics(factory promauto.Factory, opts *metricsOpts) {
+	m.dialerAttemptedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_attempted_total",
+			Help:        "Total number of connections attempted by the given dialer a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"dialer_name"})
+
+	m.dialerRetriesTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "dialer_conn_attempted_total",
-			Help:      "Total number of connections attempted by the given dialer a given name.",
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_retries_total",
+			Help:        "Total number of dials retried by the dialer of a given name after a failed attempt.",
+			ConstLabels: opts.constLabels,
 		}, []string{"dialer_name"})
 
-	dialerConnEstablishedTotal = promauto.NewCounterVec(
+	m.dialerCircuitBreakerState = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_circuit_breaker_state",
+			Help:        "State of the circuit breaker of the dialer of a given name for a given address: 0 closed, 1 half-open, 2 open.",
+			ConstLabels: opts.constLabels,
+		}, []string{"dialer_name", "addr"})
+
+	m.dialerConnEstablishedTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "dialer_conn_established_total",
-			Help:      "Total number of connections successfully established by the given dialer a given name.",
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_established_total",
+			Help:        "Total number of connections successfully established by the given dialer a given name.",
+			ConstLabels: opts.constLabels,
 		}, []string{"dialer_name"})
 
-	dialerConnFailedTotal = promauto.NewCounterVec(
+	m.dialerConnFailedTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "dialer_conn_failed_total",
-			Help:      "Total number of connections failed to dial by the dialer a given name.",
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_failed_total",
+			Help:        "Total number of connections failed to dial by the dialer a given name.",
+			ConstLabels: opts.constLabels,
 		}, []string{"dialer_name", "reason"})
 
-	dialerConnClosedTotal = promauto.NewCounterVec(
+	m.dialerConnClosedTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "dialer_conn_closed_total",
-			Help:      "Total number of connections closed which originated from the dialer of a given name.",
-		}, []string{"dialer_name"})
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_closed_total",
+			Help:        "Total number of connections closed which originated from the dialer of a given name, by the reason they were closed for.",
+			ConstLabels: opts.constLabels,
+		}, []string{"dialer_name", "closed_reason"})
 
-	dialerConnOpen = promauto.NewGaugeVec(
+	m.dialerConnOpen = factory.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "dialer_conn_open",
-			Help:      "Number of open connections which originated from the dialer of a given name.",
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_open",
+			Help:        "Number of open connections which originated from the dialer of a given name.",
+			ConstLabels: opts.constLabels,
 		}, []string{"dialer_name"})
-)
 
-// preRegisterDialerMetrics pre-populates Prometheus labels for the given dialer name, to avoid Prometheus missing labels issue.
+	m.dialerConnBytesReadTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_bytes_read_total",
+			Help:        "Total number of bytes read from connections which originated from the dialer of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"dialer_name"})
+
+	m.dialerConnBytesWrittenTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_bytes_written_total",
+			Help:        "Total number of bytes written to connections which originated from the dialer of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"dialer_name"})
+
+	m.dialerDialDuration = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_dial_duration_seconds",
+			Help:        "Duration in seconds of dial attempts by the dialer of a given name, by outcome of the attempt.",
+			ConstLabels: opts.constLabels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"dialer_name", "outcome"})
+
+	m.dialerConnDuration = newConnDurationHistograms(
+		prometheus.HistogramOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "dialer_conn_duration_seconds",
+			Help:        "Duration in seconds of connections which originated from the dialer of a given name, observed when they are closed.",
+			ConstLabels: opts.constLabels,
+		}, "dialer_name")
+}
+
+// PreRegisterDialerMetrics pre-populates Prometheus labels of `DefaultMetrics` for the given dialer name, to avoid
+// Prometheus missing labels issue.
 func PreRegisterDialerMetrics(dialerName string) {
-	dialerAttemptedTotal.WithLabelValues(dialerName)
-	dialerConnEstablishedTotal.WithLabelValues(dialerName)
-	for _, reason := range []failureReason{failedTimeout, failedResolution, failedConnRefused, failedUnknown} {
-		dialerConnFailedTotal.WithLabelValues(dialerName, string(reason))
+	DefaultMetrics.PreRegisterDialerMetrics(dialerName)
+}
+
+// PreRegisterDialerMetrics pre-populates Prometheus labels for the given dialer name, to avoid Prometheus missing labels issue.
+func (m *Metrics) PreRegisterDialerMetrics(dialerName string) {
+	m.preRegisterDialerMetrics(dialerName, durationHistogramOpts{}, nil)
+}
+
+// preRegisterDialerMetrics pre-populates the labels of the given dialer name. The custom reasons of its error classifier
+// are used for both the failed dials and the closed connections.
+func (m *Metrics) preRegisterDialerMetrics(dialerName string, durationOpts durationHistogramOpts, customReasons []string) {
+	m.dialerConnDuration.withName(dialerName, durationOpts)
+	m.dialerAttemptedTotal.WithLabelValues(dialerName)
+	m.dialerRetriesTotal.WithLabelValues(dialerName)
+	m.dialerConnEstablishedTotal.WithLabelValues(dialerName)
+	m.dialerDialDuration.WithLabelValues(dialerName, dialOutcomeSuccess)
+	for _, reason := range slices.Concat(dialFailureReasons, customReasons) {
+		m.dialerConnFailedTotal.WithLabelValues(dialerName, reason)
+		m.dialerDialDuration.WithLabelValues(dialerName, reason)
+	}
+	for _, reason := range slices.Concat(closeReasons, customReasons) {
+		m.dialerConnClosedTotal.WithLabelValues(dialerName, reason)
 	}
-	dialerConnClosedTotal.WithLabelValues(dialerName)
-	dialerConnOpen.WithLabelValues(dialerName)
+	m.dialerConnOpen.WithLabelValues(dialerName)
+	m.dialerConnBytesReadTotal.WithLabelValues(dialerName)
+	m.dialerConnBytesWrittenTotal.WithLabelValues(dialerName)
 }
 
-func reportDialerConnAttempt(dialerName string) {
-	dialerAttemptedTotal.WithLabelValues(dialerName).Inc()
+func (m *Metrics) reportDialerConnAttempt(dialerName string) {
+	m.dialerAttemptedTotal.WithLabelValues(dialerName).Inc()
 }
 
-func reportDialerConnEstablished(dialerName string) {
-	dialerConnEstablishedTotal.WithLabelValues(dialerName).Inc()
-	dialerConnOpen.WithLabelValues(dialerName).Inc()
+func (m *Metrics) reportDialerConnRetry(dialerName string) {
+	m.dialerRetriesTotal.WithLabelValues(dialerName).Inc()
 }
 
-func reportDialerConnClosed(dialerName string) {
-	dialerConnClosedTotal.WithLabelValues(dialerName).Inc()
-	dialerConnOpen.WithLabelValues(dialerName).Dec()
+func (m *Metrics) reportDialerCircuitBreakerState(dialerName string, addr string, state circuitState) {
+	m.dialerCircuitBreakerState.WithLabelValues(dialerName, addr).Set(float64(state))
 }
 
-func reportDialerConnFailed(dialerName string, err error) {
-	if netErr, ok := err.(*net.OpError); ok {
-		switch nestErr := netErr.Err.(type) {
-		case *net.DNSError:
-			dialerConnFailedTotal.WithLabelValues(dialerName, string(failedResolution)).Inc()
-			return
-		case *os.SyscallError:
-			if nestErr.Err == syscall.ECONNREFUSED {
-				dialerConnFailedTotal.WithLabelValues(dialerName, string(failedConnRefused)).Inc()
-			}
-			dialerConnFailedTotal.WithLabelValues(dialerName, string(failedUnknown)).Inc()
-			return
-		}
-		if netErr.Timeout() {
-			dialerConnFailedTotal.WithLabelValues(dialerName, string(failedTimeout)).Inc()
+func (m *Metrics) forgetDialerCircuitBreaker(dialerName string, addr string) {
+	m.dialerCircuitBreakerState.DeleteLabelValues(dialerName, addr)
+}
+
+func (m *Metrics) reportDialerConnEstablished(dialerName string, dialDuration time.Duration) {
+	m.dialerConnEstablishedTotal.WithLabelValues(dialerName).Inc()
+	m.dialerDialDuration.WithLabelValues(dialerName, dialOutcomeSuccess).Observe(dialDuration.Seconds())
+	m.dialerConnOpen.WithLabelValues(dialerName).Inc()
+}
+
+func (m *Metrics) reportDialerConnClosed(dialerName string, reason string, duration prometheus.Observer, openedAt time.Time) {
+	m.dialerConnClosedTotal.WithLabelValues(dialerName, reason).Inc()
+	m.dialerConnOpen.WithLabelValues(dialerName).Dec()
+	duration.Observe(time.Since(openedAt).Seconds())
+}
+
+// dialerConnDurationObserver returns the connection duration histogram of the given dialer name.
+func (m *Metrics) dialerConnDurationObserver(dialerName string, durationOpts durationHistogramOpts) prometheus.Observer {
+	return m.dialerConnDuration.withName(dialerName, durationOpts)
+}
+
+// dialerConnBytesCounters returns the byte counters of the given dialer name. They are resolved once per connection
+// so that accounting a Read or Write is a single atomic add.
+func (m *Metrics) dialerConnBytesCounters(dialerName string) (read prometheus.Counter, written prometheus.Counter) {
+	return m.dialerConnBytesReadTotal.WithLabelValues(dialerName), m.dialerConnBytesWrittenTotal.WithLabelValues(dialerName)
+}
+
+func (m *Metrics) reportDialerConnFailed(dialerName string, reason string, dialDuration time.Duration) {
+	m.dialerConnFailedTotal.WithLabelValues(dialerName, reason).Inc()
+	m.dialerDialDuration.WithLabelValues(dialerName, reason).Observe(dialDuration.Seconds())
+}
+
+var (
+	dialFailureClassifiersMu sync.RWMutex
+	dialFailureClassifiers   []func(error) string
+)
+
+// RegisterDialFailureClassifier makes all dialers classify their failures with the given func first, e.g. to recognize
+// the errors of a custom `DialWithDialContextFunc`. It must return one of the `DialFailed*` reasons, or an empty string
+// for errors it doesn't recognize, which are passed on to the classifiers registered before it and then the built-in
+// classification. Other values are ignored the same way, so that the cardinality of the metrics stays bounded.
+func RegisterDialFailureClassifier(classifier func(err error) string) {
+	dialFailureClassifiersMu.Lock()
+	defer dialFailureClassifiersMu.Unlock()
+	dialFailureClassifiers = append([]func(error) string{classifier}, dialFailureClassifiers...)
+}
+
+// DialFailureReason classifies the given dial error into one of the `DialFailed*` reasons, the way dialers do for
+// their metrics, trace events and logs.
+func DialFailureReason(err error) string {
+	dialFailureClassifiersMu.RLock()
+	classifiers := dialFailureClassifiers
+	dialFailureClassifiersMu.RUnlock()
+	for _, classifier := range classifiers {
+		if reason := classifier(err); slices.Contains(dialFailureReasons, reason) {
+			return reason
 		}
-	} else if err == context.Canceled || err == context.DeadlineExceeded {
-		dialerConnFailedTotal.WithLabelValues(dialerName, string(failedTimeout)).Inc()
-		return
 	}
-	dialerConnFailedTotal.WithLabelValues(dialerName, string(failedUnknown)).Inc()
+	return builtinDialFailureReason(err)
+}
+
+func builtinDialFailureReason(err error) string {
+	var (
+		opErr   *net.OpError
+		dnsErr  *net.DNSError
+		netErr  net.Error
+		certErr *tls.CertificateVerificationError
+		alert   tls.AlertError
+		record  tls.RecordHeaderError
+	)
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return DialFailedCircuitOpen
+	// Cancellation comes first, since it is wrapped in whatever the dial was doing when it got canceled.
+	case errors.Is(err, context.Canceled):
+		return DialFailedCanceled
+	// SOCKS proxies, e.g. of golang.org/x/net/proxy, report all their failures, including the ones of the dial to the
+	// proxy itself, under their own operation.
+	case errors.As(err, &opErr) && strings.HasPrefix(opErr.Op, "socks "):
+		return DialFailedProxy
+	case errors.As(err, &dnsErr):
+		return DialFailedResolution
+	case errors.As(err, &certErr), errors.As(err, &alert), errors.As(err, &record):
+		return DialFailedTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialFailedRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return DialFailedReset
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return DialFailedUnreachable
+	// EADDRNOTAVAIL is what running out of ephemeral ports looks like when dialing.
+	case errors.Is(err, syscall.EADDRINUSE), errors.Is(err, syscall.EADDRNOTAVAIL):
+		return DialFailedAddrInUse
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return DialFailedTimeout
+	}
+	return DialFailedUnknown
 }
@@ -0,0 +1,79 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+const defaultDialMaxAttempts = 3
+
+// DialRetryPolicy tells which failed dials are retried by `DialWithRetries`.
+type DialRetryPolicy struct {
+	// MaxAttempts is the number of attempts of a dial, including the first one. The default is 3.
+	MaxAttempts int
+	// Reasons are the failure reasons of the dials to retry, see `DialFailureReason`. The default is `refused`,
+	// `timeout` and `resolution`.
+	Reasons []string
+}
+
+// dialRetries retries failed dials with a backoff, as long as the context of the dial isn't done.
+type dialRetries struct {
+	backoff     backoff.Backoff
+	maxAttempts int
+	reasons     []string
+}
+
+func newDialRetries(b backoff.Backoff, policy DialRetryPolicy) *dialRetries {
+	retries := &dialRetries{backoff: b, maxAttempts: policy.MaxAttempts, reasons: policy.Reasons}
+	if retries.maxAttempts <= 0 {
+		retries.maxAttempts = defaultDialMaxAttempts
+	}
+	if retries.reasons == nil {
+		retries.reasons = []string{DialFailedRefused, DialFailedTimeout, DialFailedResolution}
+	}
+	return retries
+}
+
+// wait waits for the backoff before the next attempt of a dial that failed for the given reason. It returns false if
+// the dial must not be retried, including when ctx would be done before the next attempt.
+func (r *dialRetries) wait(ctx context.Context, attempt int, reason string) bool {
+	if r == nil || attempt >= r.maxAttempts || !slices.Contains(r.reasons, reason) || ctx.Err() != nil {
+		return false
+	}
+	wait := r.backoff.ForAttempt(float64(attempt - 1))
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// dialWithRetries dials until an attempt succeeds or isn't to be retried, returning the error of the last attempt.
+// Attempts to an address whose circuit breaker is open fail fast, without being retried.
+func dialWithRetries(ctx context.Context, network string, addr string, dialerName string, opts *dialerOpts) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		dial := &DialInfo{Name: dialerName, Network: network, Addr: addr, Attempt: attempt, Start: time.Now()}
+		circuitDial, err := opts.circuitBreakers.allow(dialerName, addr)
+		if err != nil {
+			return nil, failDialFast(ctx, dial, opts, err)
+		}
+		conn, err := dialClientConnTracker(ctx, dial, opts)
+		opts.circuitBreakers.done(ctx, circuitDial, err)
+		if err == nil || !opts.retries.wait(ctx, attempt, dial.FailureReason) {
+			return conn, err
+		}
+	}
+}
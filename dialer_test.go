@@ -5,12 +5,21 @@ package conntrack_test
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/jpillora/backoff"
 	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -116,6 +125,28 @@ func (s *DialerTestSuite) TestDialerUnderNormalConnection() {
 		"the open conn gauge must be decremented after connection was closed")
 }
 
+func (s *DialerTestSuite) TestDialerBytes() {
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("bytes_conn"))
+
+	beforeRead := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_bytes_read_total", "bytes_conn")
+	beforeWritten := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_bytes_written_total", "bytes_conn")
+
+	conn, err := dialFunc(context.TODO(), "tcp", s.serverListener.Addr().String())
+	require.NoError(s.T(), err, "NewDialContextFunc should successfully establish a conn here")
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	_, err = conn.Write([]byte(request))
+	require.NoError(s.T(), err, "writing the request must succeed")
+	response := make([]byte, 1024)
+	n, err := conn.Read(response)
+	require.NoError(s.T(), err, "reading the response must succeed")
+
+	assert.Equal(s.T(), beforeWritten+len(request), sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_bytes_written_total", "bytes_conn"),
+		"the bytes written counter must account for the request")
+	assert.Equal(s.T(), beforeRead+n, sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_bytes_read_total", "bytes_conn"),
+		"the bytes read counter must account for the response")
+}
+
 func (s *DialerTestSuite) TestDialerWithContextName() {
 	dialFunc := conntrack.NewDialContextFunc()
 	conntrack.PreRegisterDialerMetrics("ctx_conn")
@@ -146,7 +177,7 @@ func (s *ListenerTestSuite) TestDialerTracingCapturedInPage() {
 	assert.Contains(s.T(), fetchTraceEvents(s.T(), "net.ClientConn."+dialerName), conn.LocalAddr().String(),
 		"the /debug/trace/events page must contain the live connection")
 	time.Sleep(5 * time.Millisecond)
-	conn.Close()
+	s.closeAndWaitForServer(conn)
 }
 
 func (s *DialerTestSuite) TestDialerResolutionFailure() {
@@ -174,7 +205,7 @@ func (s *DialerTestSuite) TestDialerRefusedFailure() {
 
 	beforeAttempts := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_attempted_total", "ref_err")
 	beforeEstablished := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_established_total", "ref_err")
-	beforeResolutionErrors := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_failed_total", "ref_err", "resolution")
+	beforeRefusedErrors := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_failed_total", "ref_err", "refused")
 	beforeClosed := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_closed_total", "ref_err")
 
 	_, err := dialFunc(context.TODO(), "tcp", "127.0.0.1:337") // 337 is a cool port, let's hope its unused.
@@ -185,13 +216,444 @@ func (s *DialerTestSuite) TestDialerRefusedFailure() {
 		"the established conn counter must not be incremented on a failure")
 	assert.Equal(s.T(), beforeClosed, sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_closed_total", "ref_err"),
 		"the closed conn counter must not be incremented on a failure")
-	assert.Equal(s.T(), beforeResolutionErrors+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_failed_total", "ref_err", "refused"),
+	assert.Equal(s.T(), beforeRefusedErrors+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_failed_total", "ref_err", "refused"),
 		"the failure counter for connection refused error should be incremented")
 }
 
+func (s *DialerTestSuite) TestDialerDialDuration() {
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("dial_duration"))
+
+	beforeSuccess := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_dial_duration_seconds_count", "dial_duration", "success")
+	beforeRefused := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_dial_duration_seconds_count", "dial_duration", "refused")
+
+	conn, err := dialFunc(context.TODO(), "tcp", s.serverListener.Addr().String())
+	require.NoError(s.T(), err, "NewDialContextFunc should successfully establish a conn here")
+	conn.Close()
+	_, err = dialFunc(context.TODO(), "tcp", "127.0.0.1:337")
+	require.Error(s.T(), err, "NewDialContextFunc should fail here")
+
+	assert.Equal(s.T(), beforeSuccess+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_dial_duration_seconds_count", "dial_duration", "success"),
+		"the dial duration must be observed with the success outcome")
+	assert.Equal(s.T(), beforeRefused+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_dial_duration_seconds_count", "dial_duration", "refused"),
+		"the dial duration must be observed with the failure reason as outcome")
+}
+
+func (s *DialerTestSuite) TestDialerIdleTimeout() {
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("idle_conn"), conntrack.DialWithIdleTimeout(50*time.Millisecond))
+	beforeIdle := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_closed_total", "idle_conn", "idle")
+
+	conn, err := dialFunc(context.TODO(), "tcp", s.serverListener.Addr().String())
+	require.NoError(s.T(), err, "NewDialContextFunc should successfully establish a conn here")
+	defer conn.Close()
+
+	require.NoError(s.T(), conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(s.T(), err, net.ErrClosed, "the idle connection must be closed by the dialer")
+	assert.Eventually(s.T(), func() bool {
+		return sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_closed_total", "idle_conn", "idle") == beforeIdle+1
+	}, time.Second, 5*time.Millisecond, "the close must be counted with the idle reason")
+}
+
+func (s *DialerTestSuite) TestDialerCloseReasonRemoteEOF() {
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("remote_eof"))
+	beforeEOF := sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_closed_total", "remote_eof", "remote_eof")
+
+	conn, err := dialFunc(context.TODO(), "tcp", s.serverListener.Addr().String())
+	require.NoError(s.T(), err, "NewDialContextFunc should successfully establish a conn here")
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(s.T(), err, "writing the request must succeed")
+	_, err = io.ReadAll(conn)
+	require.NoError(s.T(), err, "the server must close the connection after the response")
+	conn.Close()
+
+	assert.Equal(s.T(), beforeEOF+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_dialer_conn_closed_total", "remote_eof", "remote_eof"),
+		"the close must be counted with the remote_eof reason")
+}
+
 func (s *DialerTestSuite) TearDownSuite() {
 	if s.serverListener != nil {
 		s.T().Logf("stopped http.Server at: %v", s.serverListener.Addr().String())
 		s.serverListener.Close()
 	}
 }
+
+type tunnelError struct{ refused bool }
+
+func (e *tunnelError) Error() string {
+	return fmt.Sprintf("tunnel failed (refused: %v)", e.refused)
+}
+
+func TestDialFailureReason(t *testing.T) {
+	conntrack.RegisterDialFailureClassifier(func(err error) string {
+		var tunnelErr *tunnelError
+		if !errors.As(err, &tunnelErr) {
+			return ""
+		}
+		if tunnelErr.refused {
+			return conntrack.DialFailedRefused
+		}
+		return "tunnel"
+	})
+	opError := func(op string, err error) error {
+		return &net.OpError{Op: op, Net: "tcp", Err: err}
+	}
+	for _, testCase := range []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{"refused", opError("dial", os.NewSyscallError("connect", syscall.ECONNREFUSED)), conntrack.DialFailedRefused},
+		{"wrapped refused", fmt.Errorf("custom dialer: %w", opError("dial", os.NewSyscallError("connect", syscall.ECONNREFUSED))), conntrack.DialFailedRefused},
+		{"resolution", opError("dial", &net.DNSError{Err: "no such host", Name: "wrong.domain", IsNotFound: true}), conntrack.DialFailedResolution},
+		{"resolution timeout", opError("dial", &net.DNSError{Err: "i/o timeout", Name: "slow.domain", IsTimeout: true}), conntrack.DialFailedResolution},
+		{"deadline", opError("dial", os.ErrDeadlineExceeded), conntrack.DialFailedTimeout},
+		{"syscall timeout", opError("dial", os.NewSyscallError("connect", syscall.ETIMEDOUT)), conntrack.DialFailedTimeout},
+		{"context deadline", context.DeadlineExceeded, conntrack.DialFailedTimeout},
+		{"canceled", opError("dial", fmt.Errorf("operation was canceled: %w", context.Canceled)), conntrack.DialFailedCanceled},
+		{"reset", opError("dial", os.NewSyscallError("connect", syscall.ECONNRESET)), conntrack.DialFailedReset},
+		{"host unreachable", opError("dial", os.NewSyscallError("connect", syscall.EHOSTUNREACH)), conntrack.DialFailedUnreachable},
+		{"network unreachable", opError("dial", os.NewSyscallError("connect", syscall.ENETUNREACH)), conntrack.DialFailedUnreachable},
+		{"address in use", opError("dial", os.NewSyscallError("bind", syscall.EADDRINUSE)), conntrack.DialFailedAddrInUse},
+		{"ephemeral ports exhausted", opError("dial", os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)), conntrack.DialFailedAddrInUse},
+		{"tls alert", fmt.Errorf("handshake: %w", tls.AlertError(40)), conntrack.DialFailedTLS},
+		{"tls certificate", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, conntrack.DialFailedTLS},
+		{"tls record", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, conntrack.DialFailedTLS},
+		{"proxy", opError("socks connect", os.NewSyscallError("connect", syscall.ECONNREFUSED)), conntrack.DialFailedProxy},
+		{"circuit open", &conntrack.CircuitOpenError{Addr: "127.0.0.1:80"}, conntrack.DialFailedCircuitOpen},
+		{"registered classifier", fmt.Errorf("ssh: %w", &tunnelError{refused: true}), conntrack.DialFailedRefused},
+		{"registered classifier with out-of-set reason", fmt.Errorf("%w: %w", &tunnelError{}, syscall.ECONNRESET), conntrack.DialFailedReset},
+		{"unknown", errors.New("something else"), conntrack.DialFailedUnknown},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.reason, conntrack.DialFailureReason(testCase.err))
+		})
+	}
+}
+
+func TestDialerFailureReasonWrapped(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("wrapped_err"),
+		conntrack.DialWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.DialWithDialContextFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			_, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return nil, fmt.Errorf("custom dialer: %w", err)
+		}))
+
+	_, err := dialFunc(context.TODO(), "tcp", "127.0.0.1:337")
+	require.Error(t, err, "dialing a closed port must fail")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_failed_total", "wrapped_err", "refused"),
+		"the wrapped error must be classified")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_failed_total", "wrapped_err"),
+		"the failure must be counted under a single reason")
+}
+
+var errSSHAuth = errors.New("ssh: unable to authenticate")
+
+func TestDialerErrorClassifier(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("error_classifier"),
+		conntrack.DialWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.DialWithErrorClassifier(func(err error) string {
+			if errors.Is(err, errSSHAuth) {
+				return "ssh_auth"
+			}
+			return ""
+		}, "ssh_auth"),
+		conntrack.DialWithDialContextFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if addr == "bastion:22" {
+				return nil, fmt.Errorf("tunnel: %w", errSSHAuth)
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}))
+
+	assert.Len(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_dialer_conn_failed_total", "error_classifier", "ssh_auth"), 1,
+		"the custom reasons must be pre-registered")
+	_, err := dialFunc(context.TODO(), "tcp", "bastion:22")
+	require.ErrorIs(t, err, errSSHAuth)
+	_, err = dialFunc(context.TODO(), "tcp", "127.0.0.1:337")
+	require.Error(t, err, "dialing a closed port must fail")
+
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_failed_total", "error_classifier", "ssh_auth"),
+		"the domain error must be counted with the custom reason")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_failed_total", "error_classifier", "refused"),
+		"unrecognized errors must be classified by the built-in classification")
+}
+
+func TestDialerRetries(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	defer server.Close()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	// newDialFunc returns a dial func that fails with the given errors before dialing the server.
+	newDialFunc := func(name string, reg prometheus.Registerer, policy conntrack.DialRetryPolicy, errs ...error) func(context.Context, string, string) (net.Conn, error) {
+		return conntrack.NewDialContextFunc(
+			conntrack.DialWithName(name),
+			conntrack.DialWithMetrics(conntrack.NewMetrics(reg)),
+			conntrack.DialWithTracing(),
+			conntrack.DialWithRetries(backoff.Backoff{Min: time.Millisecond, Max: time.Millisecond}, policy),
+			conntrack.DialWithDialContextFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				if len(errs) > 0 {
+					err := errs[0]
+					errs = errs[1:]
+					return nil, err
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}))
+	}
+
+	t.Run("retried", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		dialFunc := newDialFunc("retried", reg, conntrack.DialRetryPolicy{}, refused, refused)
+		conn, err := dialFunc(context.TODO(), "tcp", server.Addr().String())
+		require.NoError(t, err, "the dial must succeed once retried")
+		defer conn.Close()
+		assert.Equal(t, 3, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_attempted_total", "retried"),
+			"every attempt must be counted")
+		assert.Equal(t, 2, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_retries_total", "retried"),
+			"every retry must be counted")
+		assert.Equal(t, 2, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_failed_total", "retried", "refused"),
+			"every failed attempt must be counted")
+		assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_established_total", "retried"))
+		assert.Contains(t, fetchTraceEvents(t, "net.ClientConn.retried"), "retrying: attempt 3",
+			"the retries must be traced")
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		dialFunc := newDialFunc("max_attempts", reg, conntrack.DialRetryPolicy{MaxAttempts: 2}, refused, refused)
+		_, err := dialFunc(context.TODO(), "tcp", server.Addr().String())
+		require.ErrorIs(t, err, syscall.ECONNREFUSED, "the error of the last attempt must be returned")
+		assert.Equal(t, 2, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_attempted_total", "max_attempts"))
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		dialFunc := newDialFunc("not_retryable", reg, conntrack.DialRetryPolicy{}, errors.New("something else"))
+		_, err := dialFunc(context.TODO(), "tcp", server.Addr().String())
+		require.Error(t, err, "failures of other reasons must not be retried")
+		assert.Equal(t, 0, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_retries_total", "not_retryable"))
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		dialFunc := conntrack.NewDialContextFunc(
+			conntrack.DialWithName("deadline"),
+			conntrack.DialWithMetrics(conntrack.NewMetrics(reg)),
+			conntrack.DialWithRetries(backoff.Backoff{Min: time.Minute, Max: time.Minute}, conntrack.DialRetryPolicy{}),
+			conntrack.DialWithDialContextFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return nil, refused
+			}))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		start := time.Now()
+		_, err := dialFunc(ctx, "tcp", server.Addr().String())
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.Less(t, time.Since(start), time.Second, "the dial must not wait for a retry past the deadline of its context")
+		assert.Equal(t, 0, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_retries_total", "deadline"))
+	})
+}
+
+func TestDialerCircuitBreaker(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	defer server.Close()
+	addr := server.Addr().String()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	// newDialFunc returns a dial func that fails with refused while failing is set.
+	newDialFunc := func(name string, reg prometheus.Registerer, cfg conntrack.CircuitBreakerConfig, failing *bool) func(context.Context, string, string) (net.Conn, error) {
+		return conntrack.NewDialContextFunc(
+			conntrack.DialWithName(name),
+			conntrack.DialWithMetrics(conntrack.NewMetrics(reg)),
+			conntrack.DialWithTracing(),
+			conntrack.DialWithCircuitBreaker(cfg),
+			conntrack.DialWithDialContextFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				if *failing {
+					return nil, refused
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}))
+	}
+
+	t.Run("consecutive failures", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		failing := true
+		dialFunc := newDialFunc("consecutive", reg, conntrack.CircuitBreakerConfig{ConsecutiveFailures: 3, OpenFor: 50 * time.Millisecond}, &failing)
+		for range 3 {
+			_, err := dialFunc(context.TODO(), "tcp", addr)
+			require.ErrorIs(t, err, syscall.ECONNREFUSED, "dials must go through while the breaker is closed")
+		}
+		_, err := dialFunc(context.TODO(), "tcp", addr)
+		require.ErrorIs(t, err, conntrack.ErrCircuitOpen, "dials must fail fast while the breaker is open")
+		var openErr *conntrack.CircuitOpenError
+		require.ErrorAs(t, err, &openErr)
+		assert.Equal(t, addr, openErr.Addr)
+		assert.Equal(t, 4, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_attempted_total", "consecutive"),
+			"dials failing fast must be counted as attempted, like any failed dial")
+		assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_failed_total", "consecutive", conntrack.DialFailedCircuitOpen),
+			"dials failing fast must be counted with the circuit_open reason")
+		assert.Equal(t, 2, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "consecutive", addr),
+			"the gauge must report the breaker as open")
+		assert.Contains(t, fetchTraceEvents(t, "net.ClientConn.consecutive"), "closed -&gt; open",
+			"the transition must be traced")
+
+		time.Sleep(60 * time.Millisecond)
+		failing = false
+		conn, err := dialFunc(context.TODO(), "tcp", addr)
+		require.NoError(t, err, "the trial dial must go through once the breaker is half-open")
+		defer conn.Close()
+		assert.Equal(t, 0, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "consecutive", addr),
+			"the successful trial dial must close the breaker")
+		events := fetchTraceEvents(t, "net.ClientConn.consecutive")
+		assert.Contains(t, events, "open -&gt; half-open")
+		assert.Contains(t, events, "half-open -&gt; closed")
+	})
+
+	t.Run("failed trial", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		failing := true
+		dialFunc := newDialFunc("failed_trial", reg, conntrack.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenFor: 50 * time.Millisecond}, &failing)
+		_, err := dialFunc(context.TODO(), "tcp", addr)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		time.Sleep(60 * time.Millisecond)
+		_, err = dialFunc(context.TODO(), "tcp", addr)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED, "the trial dial must go through once the breaker is half-open")
+		_, err = dialFunc(context.TODO(), "tcp", addr)
+		require.ErrorIs(t, err, conntrack.ErrCircuitOpen, "the failed trial dial must open the breaker again")
+	})
+
+	t.Run("dial cut short by the caller", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		dialFunc := conntrack.NewDialContextFunc(
+			conntrack.DialWithName("cut_short"),
+			conntrack.DialWithMetrics(conntrack.NewMetrics(reg)),
+			conntrack.DialWithCircuitBreaker(conntrack.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenFor: time.Minute}),
+			conntrack.DialWithDialContextFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+			}))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := dialFunc(ctx, "tcp", addr)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		canceledCtx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = dialFunc(canceledCtx, "tcp", addr)
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 0, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "cut_short", addr),
+			"dials the caller gave up on must not open the breaker")
+	})
+
+	t.Run("slow dial during trial", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		// Every dial signals that it started, then waits for the result sent on the channel of its context.
+		type resultKey struct{}
+		started := make(chan struct{}, 3)
+		dialFunc := conntrack.NewDialContextFunc(
+			conntrack.DialWithName("slow_dial"),
+			conntrack.DialWithMetrics(conntrack.NewMetrics(reg)),
+			conntrack.DialWithCircuitBreaker(conntrack.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenFor: 50 * time.Millisecond}),
+			conntrack.DialWithDialContextFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				started <- struct{}{}
+				if err := <-ctx.Value(resultKey{}).(chan error); err != nil {
+					return nil, err
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}))
+		dial := func(result chan error) <-chan error {
+			done := make(chan error, 1)
+			go func() {
+				conn, err := dialFunc(context.WithValue(context.Background(), resultKey{}, result), "tcp", addr)
+				if err == nil {
+					conn.Close()
+				}
+				done <- err
+			}()
+			return done
+		}
+
+		slowResult := make(chan error, 1)
+		slowDone := dial(slowResult)
+		<-started
+		failedResult := make(chan error, 1)
+		failedResult <- refused
+		require.ErrorIs(t, <-dial(failedResult), syscall.ECONNREFUSED)
+		<-started
+		time.Sleep(60 * time.Millisecond)
+		trialResult := make(chan error, 1)
+		trialDone := dial(trialResult)
+		<-started
+		assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "slow_dial", addr),
+			"the trial dial must turn the breaker half-open")
+
+		slowResult <- nil
+		require.NoError(t, <-slowDone, "the dial started before the breaker opened must succeed")
+		assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "slow_dial", addr),
+			"only the trial dial may close the breaker")
+		otherResult := make(chan error, 1)
+		otherResult <- refused
+		require.ErrorIs(t, <-dial(otherResult), conntrack.ErrCircuitOpen, "no other dial may go through during the trial")
+
+		trialResult <- refused
+		require.ErrorIs(t, <-trialDone, syscall.ECONNREFUSED)
+		assert.Equal(t, 2, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "slow_dial", addr),
+			"the failed trial dial must open the breaker again")
+	})
+
+	t.Run("idle breakers", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		failing := true
+		dialFunc := newDialFunc("idle", reg, conntrack.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenFor: 100 * time.Millisecond, IdleTimeout: 50 * time.Millisecond}, &failing)
+		ctx := conntrack.DialNameToContext(context.TODO(), "idle_ctx")
+		_, err := dialFunc(ctx, "tcp", addr)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.Equal(t, 2, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "idle_ctx", addr),
+			"the breaker must be reported under the dialer name of the context")
+		assert.Contains(t, fetchTraceEvents(t, "net.ClientConn.idle_ctx"), "closed -&gt; open",
+			"the transition must be traced under the dialer name of the context")
+		failing = false
+		conn, err := dialFunc(context.TODO(), "tcp", addr)
+		require.NoError(t, err, "the breaker of another dialer name must be closed")
+		conn.Close()
+
+		time.Sleep(60 * time.Millisecond)
+		conn, err = dialFunc(conntrack.DialNameToContext(context.TODO(), "idle_other"), "tcp", addr)
+		require.NoError(t, err)
+		conn.Close()
+		assert.Empty(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "idle", addr),
+			"the idle closed breaker must be dropped")
+		assert.Len(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "idle_ctx", addr), 1,
+			"the open breaker must be kept until IdleTimeout past the time it would let a trial dial through")
+		assert.Len(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "idle_other", addr), 1)
+
+		time.Sleep(120 * time.Millisecond)
+		conn, err = dialFunc(conntrack.DialNameToContext(context.TODO(), "idle_other"), "tcp", addr)
+		require.NoError(t, err)
+		conn.Close()
+		assert.Empty(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "idle_ctx", addr),
+			"the idle open breaker must be dropped")
+		assert.Len(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "idle_other", addr), 1,
+			"the breaker still dialed must be kept")
+	})
+
+	t.Run("failure ratio", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		failing := false
+		dialFunc := newDialFunc("ratio", reg, conntrack.CircuitBreakerConfig{FailureRatio: 0.5, MinDials: 4}, &failing)
+		for _, fail := range []bool{false, true, false} {
+			failing = fail
+			conn, err := dialFunc(context.TODO(), "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+		}
+		assert.Equal(t, 0, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_circuit_breaker_state", "ratio", addr),
+			"the breaker must stay closed below the minimum number of dials")
+		failing = true
+		_, err := dialFunc(context.TODO(), "tcp", addr)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		_, err = dialFunc(context.TODO(), "tcp", addr)
+		require.ErrorIs(t, err, conntrack.ErrCircuitOpen, "the breaker must open once half of the dials failed")
+	})
+}
@@ -5,11 +5,14 @@ package conntrack
 
 import (
 	"context"
-	"fmt"
+	"io"
+	"log/slog"
 	"net"
-	"sync"
+	"time"
 
-	"golang.org/x/net/trace"
+	"github.com/jpillora/backoff"
+	"go.opentelemetry.io/otel/metric"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 type dialerOpts struct {
@@ -17,6 +20,20 @@ type dialerOpts struct {
 	monitoring            bool
 	tracing               bool
 	parentDialContextFunc dialerContextFunc
+	metrics               *Metrics
+	duration              durationHistogramOpts
+	idleTimeout           time.Duration
+	meterProvider         metric.MeterProvider
+	tracerProvider        oteltrace.TracerProvider
+	connSpans             bool
+	observers             []ConnObserver
+	errorClassifier       *errorClassifier
+	retries               *dialRetries
+	circuitBreaker        *CircuitBreakerConfig
+	circuitBreakers       *circuitBreakers
+
+	// transferObservers are the observers notified of Reads and Writes, see `transferObservers`.
+	transferObservers []ConnObserver
 }
 
 // DialerOpt defines a config option you can set on the dialer.
@@ -40,6 +57,37 @@ func DialWithoutMonitoring() DialerOpt {
 	}
 }
 
+// DialWithMetrics makes the dialer report to the given Metrics instead of `DefaultMetrics`.
+func DialWithMetrics(m *Metrics) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.metrics = m
+	}
+}
+
+// DialWithDurationBuckets overrides the buckets of the connection duration histogram of this dialer.
+// The buckets of the first dialer used with a given name are used for all dialers sharing that name.
+func DialWithDurationBuckets(buckets []float64) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.duration.buckets = buckets
+	}
+}
+
+// DialWithNativeDurationHistogram turns *on* the native (sparse) histogram for the connection duration of this
+// dialer, using the given bucket growth factor (e.g. 1.1). Classic buckets keep being exposed alongside it.
+func DialWithNativeDurationHistogram(bucketFactor float64) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.duration.nativeBucketFactor = bucketFactor
+	}
+}
+
+// DialWithMeterProvider makes the dialer report its metrics as OpenTelemetry instruments of the given provider too.
+// Use `DialWithoutMonitoring` to report them to OpenTelemetry only.
+func DialWithMeterProvider(provider metric.MeterProvider) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.meterProvider = provider
+	}
+}
+
 // DialWithTracing turns *on* the /debug/events tracing of the dial calls.
 func DialWithTracing() DialerOpt {
 	return func(opts *dialerOpts) {
@@ -47,6 +95,83 @@ func DialWithTracing() DialerOpt {
 	}
 }
 
+// DialWithLogger makes the dialer log established and closed connections, as well as failed dials, as structured
+// records to the given logger. Use `LoggerWithLevel` to change the level of each event.
+func DialWithLogger(logger *slog.Logger, optFuncs ...LoggerOpt) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.observers = append(opts.observers, NewSlogObserver(logger, optFuncs...))
+	}
+}
+
+// DialWithObserver makes the dialer notify the given observers of its dials and the connections it establishes, after
+// the built-in Prometheus, tracing and OpenTelemetry ones. It can be used more than once to add several observers.
+func DialWithObserver(observers ...ConnObserver) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.observers = append(opts.observers, observers...)
+	}
+}
+
+// DialWithIdleTimeout makes the dialer close connections on which no Read or Write happened for the given timeout.
+// Such closes are reported with the `idle` reason.
+// A value of 0 disables it.
+func DialWithIdleTimeout(timeout time.Duration) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.idleTimeout = timeout
+	}
+}
+
+// DialWithTracerProvider turns *on* OpenTelemetry spans of the dial calls, covering name resolution and connecting.
+// The dial span is a child of the span of the dial context, so that slow dials show up in the trace of the request
+// they were made for.
+func DialWithTracerProvider(provider oteltrace.TracerProvider) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.tracerProvider = provider
+	}
+}
+
+// DialWithConnectionSpans turns *on* an OpenTelemetry span for the whole lifetime of the dialed connections, with
+// events for their first error and their close. Connections usually outlive the request they were dialed for, so
+// the span is the root of its own trace, linked to the dial span. Only applies together with `DialWithTracerProvider`.
+func DialWithConnectionSpans() DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.connSpans = true
+	}
+}
+
+// DialWithRetries makes the dialer retry dials that failed for one of the reasons of the given policy, waiting for the
+// given backoff between attempts. Retries stop once the context of the dial is done, or would be before the next
+// attempt. Every attempt is reported on its own, e.g. in `dialer_conn_attempted_total`, and every retry is counted in
+// `dialer_conn_retries_total`.
+func DialWithRetries(b backoff.Backoff, policy DialRetryPolicy) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.retries = newDialRetries(b, policy)
+	}
+}
+
+// DialWithCircuitBreaker makes the dialer keep a circuit breaker per dialed address and dialer name, see
+// `DialNameToContext`, which opens once dials to the address keep failing as set by the given config. While it is open,
+// dials to the address fail fast with a `CircuitOpenError`, saving callers from waiting on a dead backend. Such dials
+// are reported to the observers with the `circuit_open` failure reason, e.g. in `dialer_conn_failed_total`. The state of
+// the breakers is monitored by the `dialer_circuit_breaker_state` gauge, and their transitions are traced on
+// /debug/events with `DialWithTracing`.
+func DialWithCircuitBreaker(cfg CircuitBreakerConfig) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.circuitBreaker = &cfg
+	}
+}
+
+// DialWithErrorClassifier makes the dialer classify errors with the given func before the built-in classification:
+// dial errors into the `reason` of `dialer_conn_failed_total`, e.g. for the domain errors of a custom
+// `DialWithDialContextFunc`, and Read and Write errors into the reason connections are closed for. The func must
+// return one of the given reasons, a built-in one, or an empty string for errors it doesn't recognize, which are passed
+// on to the built-in classification. Other values are ignored the same way, so that the cardinality of the metrics
+// stays bounded, like for `RegisterDialFailureClassifier`.
+func DialWithErrorClassifier(classifier func(err error) string, reasons ...string) DialerOpt {
+	return func(opts *dialerOpts) {
+		opts.errorClassifier = &errorClassifier{classify: classifier, reasons: reasons}
+	}
+}
+
 // DialWithDialer allows you to override the `net.Dialer` instance used to actually conduct the dials.
 func DialWithDialer(parentDialer *net.Dialer) DialerOpt {
 	return DialWithDialContextFunc(parentDialer.DialContext)
@@ -78,19 +203,40 @@ func DialNameToContext(ctx context.Context, dialerName string) context.Context {
 // NewDialContextFunc returns a `DialContext` function that tracks outbound connections.
 // The signature is compatible with `http.Tranport.DialContext` and is meant to be used there.
 func NewDialContextFunc(optFuncs ...DialerOpt) func(context.Context, string, string) (net.Conn, error) {
-	opts := &dialerOpts{name: defaultName, monitoring: true, parentDialContextFunc: (&net.Dialer{}).DialContext}
+	opts := &dialerOpts{
+		name:                  defaultName,
+		monitoring:            true,
+		parentDialContextFunc: (&net.Dialer{}).DialContext,
+		metrics:               DefaultMetrics,
+	}
 	for _, f := range optFuncs {
 		f(opts)
 	}
+	var observers []ConnObserver
 	if opts.monitoring {
-		PreRegisterDialerMetrics(opts.name)
+		opts.metrics.preRegisterDialerMetrics(opts.name, opts.duration, opts.errorClassifier.customReasons())
+		observers = append(observers, &prometheusObserver{metrics: opts.metrics, duration: opts.duration})
+	}
+	if opts.tracing {
+		observers = append(observers, NewEventLogObserver())
+	}
+	if opts.meterProvider != nil {
+		observers = append(observers, NewOTelMetricsObserver(opts.meterProvider))
+	}
+	if opts.tracerProvider != nil {
+		observers = append(observers, NewOTelTracingObserver(opts.tracerProvider, opts.connSpans))
+	}
+	opts.observers = append(observers, opts.observers...)
+	opts.transferObservers = transferObservers(opts.observers)
+	if opts.circuitBreaker != nil {
+		opts.circuitBreakers = newCircuitBreakers(*opts.circuitBreaker, opts)
 	}
 	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
 		name := opts.name
 		if ctxName := DialNameFromContext(ctx); ctxName != "" {
 			name = ctxName
 		}
-		return dialClientConnTracker(ctx, network, addr, name, opts)
+		return dialWithRetries(ctx, network, addr, name, opts)
 	}
 }
 
@@ -105,61 +251,94 @@ func NewDialFunc(optFuncs ...DialerOpt) func(string, string) (net.Conn, error) {
 
 type clientConnTracker struct {
 	net.Conn
-	opts       *dialerOpts
-	dialerName string
-	event      trace.EventLog
-	mu         sync.Mutex
+	connStats
+	opts *dialerOpts
 }
 
-func dialClientConnTracker(ctx context.Context, network string, addr string, dialerName string, opts *dialerOpts) (net.Conn, error) {
-	var event trace.EventLog
-	if opts.tracing {
-		event = trace.NewEventLog(fmt.Sprintf("net.ClientConn.%s", dialerName), fmt.Sprintf("%v", addr))
-	}
-	if opts.monitoring {
-		reportDialerConnAttempt(dialerName)
+func dialClientConnTracker(ctx context.Context, dial *DialInfo, opts *dialerOpts) (net.Conn, error) {
+	for _, observer := range opts.observers {
+		ctx = observer.OnDialStart(ctx, dial)
 	}
-	conn, err := opts.parentDialContextFunc(ctx, network, addr)
+	conn, err := opts.parentDialContextFunc(ctx, dial.Network, dial.Addr)
+	dial.Duration = time.Since(dial.Start)
 	if err != nil {
-		if event != nil {
-			event.Errorf("failed dialing: %v", err)
-			event.Finish()
-		}
-		if opts.monitoring {
-			reportDialerConnFailed(dialerName, err)
+		dial.FailureReason = opts.errorClassifier.dialFailureReason(err)
+		for _, observer := range opts.observers {
+			observer.OnDialDone(ctx, dial, nil, err)
 		}
 		return nil, err
 	}
-	if event != nil {
-		event.Printf("established: %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+	tracker := &clientConnTracker{
+		Conn: conn,
+		opts: opts,
 	}
-	if opts.monitoring {
-		reportDialerConnEstablished(dialerName)
+	tracker.connStats.init(tracker, ConnKindDialer, dial.Name)
+	tracker.errorClassifier = opts.errorClassifier
+	tracker.transferObservers = opts.transferObservers
+	// The connection outlives the dial, so observers get to keep the values of its context but not its cancellation.
+	tracker.observe(context.WithoutCancel(ctx), opts.observers, func(ctx context.Context, observer ConnObserver) context.Context {
+		return observer.OnDialDone(ctx, dial, &tracker.observed, nil)
+	})
+	registry.register(tracker)
+	if opts.idleTimeout > 0 {
+		tracker.watchIdle(tracker, opts.idleTimeout)
 	}
-	tracker := &clientConnTracker{
-		Conn:       conn,
-		opts:       opts,
-		dialerName: dialerName,
-		event:      event,
+	return withOptionalInterfaces(tracker), nil
+}
+
+// failDialFast reports a dial that failed without reaching the parent dialer, e.g. because of an open circuit breaker,
+// to the observers like any other failed dial.
+func failDialFast(ctx context.Context, dial *DialInfo, opts *dialerOpts, err error) error {
+	for _, observer := range opts.observers {
+		ctx = observer.OnDialStart(ctx, dial)
+	}
+	dial.Duration = time.Since(dial.Start)
+	dial.FailureReason = opts.errorClassifier.dialFailureReason(err)
+	for _, observer := range opts.observers {
+		observer.OnDialDone(ctx, dial, nil, err)
 	}
-	return tracker, nil
+	return err
+}
+
+func (ct *clientConnTracker) stats() *connStats {
+	return &ct.connStats
+}
+
+func (ct *clientConnTracker) innerConn() net.Conn {
+	return ct.Conn
+}
+
+func (ct *clientConnTracker) Read(b []byte) (int, error) {
+	n, err := ct.Conn.Read(b)
+	ct.onRead(n, err)
+	return n, err
+}
+
+func (ct *clientConnTracker) Write(b []byte) (int, error) {
+	n, err := ct.Conn.Write(b)
+	ct.onWrite(n, err)
+	return n, err
+}
+
+// ReadFrom implements `io.ReaderFrom`, keeping the zero-copy transfers of the inner connection for `io.Copy`.
+func (ct *clientConnTracker) ReadFrom(r io.Reader) (int64, error) {
+	return ct.readFrom(ct.Conn, r)
+}
+
+// WriteTo implements `io.WriterTo`, keeping the zero-copy transfers of the inner connection for `io.Copy`.
+func (ct *clientConnTracker) WriteTo(w io.Writer) (int64, error) {
+	return ct.writeTo(ct, ct.Conn, w)
 }
 
 func (ct *clientConnTracker) Close() error {
-	err := ct.Conn.Close()
-	ct.mu.Lock()
-	if ct.event != nil {
-		if err != nil {
-			ct.event.Errorf("failed closing: %v", err)
-		} else {
-			ct.event.Printf("closing")
-		}
-		ct.event.Finish()
-		ct.event = nil
-	}
-	ct.mu.Unlock()
-	if ct.opts.monitoring {
-		reportDialerConnClosed(ct.dialerName)
+	if !ct.closed.CompareAndSwap(false, true) {
+		// Only the first Close is accounted for, so that the open connections gauge never drifts.
+		return ct.Conn.Close()
 	}
+	ct.stopTimers()
+	err := ct.Conn.Close()
+	reason := ct.closedReason()
+	registry.unregister(ct)
+	ct.onClose(reason, err)
 	return err
 }
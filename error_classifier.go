@@ -0,0 +1,57 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"slices"
+)
+
+// errorClassifier classifies errors into a bounded set of custom reasons before the built-in classification, see
+// `TrackWithErrorClassifier` and `DialWithErrorClassifier`.
+type errorClassifier struct {
+	classify func(err error) string
+	reasons  []string
+}
+
+// reason returns the reason err is classified into, if it is one of the custom reasons or of the given built-in ones.
+// Otherwise, or without a classifier, it returns an empty string for the built-in classification to apply.
+func (c *errorClassifier) reason(err error, builtin []string) string {
+	if c == nil {
+		return ""
+	}
+	reason := c.classify(err)
+	if slices.Contains(c.reasons, reason) || slices.Contains(builtin, reason) {
+		return reason
+	}
+	return ""
+}
+
+// customReasons returns the custom reasons of the classifier, to pre-populate the labels of the metrics with.
+func (c *errorClassifier) customReasons() []string {
+	if c == nil {
+		return nil
+	}
+	return c.reasons
+}
+
+func (c *errorClassifier) dialFailureReason(err error) string {
+	if reason := c.reason(err, dialFailureReasons); reason != "" {
+		return reason
+	}
+	return DialFailureReason(err)
+}
+
+func (c *errorClassifier) acceptFailureReason(err error) string {
+	if reason := c.reason(err, acceptFailureReasons); reason != "" {
+		return reason
+	}
+	return acceptFailureReason(err)
+}
+
+func (c *errorClassifier) terminalErrorReason(err error) string {
+	if reason := c.reason(err, closeReasons); reason != "" {
+		return reason
+	}
+	return terminalErrorReason(err)
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/net/trace"
+)
+
+// eventLogObserver traces every connection as an x/net/trace event log, browsable on /debug/events.
+type eventLogObserver struct {
+	NoopObserver
+}
+
+// NewEventLogObserver returns an observer tracing connections on the /debug/events page of x/net/trace, which is what
+// `TrackWithTracing` and `DialWithTracing` turn on. Accepted connections are traced in the `net.ServerConn.<name>`
+// family and dialed ones in the `net.ClientConn.<name>` family.
+func NewEventLogObserver() ConnObserver {
+	return &eventLogObserver{}
+}
+
+func (o *eventLogObserver) OnAccept(ctx context.Context, conn *ObservedConn) context.Context {
+	event := trace.NewEventLog(fmt.Sprintf("net.ServerConn.%s", conn.Name), fmt.Sprintf("%v", conn.Conn.RemoteAddr()))
+	event.Printf("accepted: %v -> %v", conn.Conn.RemoteAddr(), conn.Conn.LocalAddr())
+	return context.WithValue(ctx, o, event)
+}
+
+func (o *eventLogObserver) OnDialStart(ctx context.Context, dial *DialInfo) context.Context {
+	event := trace.NewEventLog(fmt.Sprintf("net.ClientConn.%s", dial.Name), fmt.Sprintf("%v", dial.Addr))
+	if dial.Attempt > 1 {
+		event.Printf("retrying: attempt %d", dial.Attempt)
+	}
+	return context.WithValue(ctx, o, event)
+}
+
+func (o *eventLogObserver) OnDialDone(ctx context.Context, _ *DialInfo, conn *ObservedConn, err error) context.Context {
+	event, ok := ctx.Value(o).(trace.EventLog)
+	if !ok {
+		return ctx
+	}
+	if err != nil {
+		event.Errorf("failed dialing: %v", err)
+		event.Finish()
+		return ctx
+	}
+	event.Printf("established: %s -> %s", conn.Conn.LocalAddr(), conn.Conn.RemoteAddr())
+	return ctx
+}
+
+func (o *eventLogObserver) OnClose(ctx context.Context, _ *ObservedConn, reason string, err error) {
+	event, ok := ctx.Value(o).(trace.EventLog)
+	if !ok {
+		return
+	}
+	if err != nil {
+		event.Errorf("failed closing (%s): %v", reason, err)
+	} else {
+		event.Printf("closing (%s)", reason)
+	}
+	event.Finish()
+}
@@ -54,6 +54,7 @@ func main() {
 
 	http.DefaultServeMux.Handle("/", http.HandlerFunc(handler))
 	http.DefaultServeMux.Handle("/metrics", promhttp.Handler())
+	http.DefaultServeMux.Handle("/debug/conns", conntrack.DebugHandler())
 
 	httpServer := http.Server{
 		Handler: http.DefaultServeMux,
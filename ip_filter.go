@@ -0,0 +1,96 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	rejectedIPFilter = "ip_filter"
+)
+
+// IPFilter decides which remote IPs are allowed to connect to a listener, see `TrackWithIPFilter`.
+// The deny list takes precedence over the allow list, and an empty allow list allows every IP that isn't denied.
+// The lists can be replaced at runtime with `Update`, which is safe to call while the listener is accepting.
+// The zero value has empty lists, so allows every IP.
+type IPFilter struct {
+	lists atomic.Pointer[ipFilterLists]
+}
+
+type ipFilterLists struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewIPFilter returns a filter for the given allow and deny lists. Entries are either CIDRs (e.g. `10.0.0.0/8`)
+// or single IPs.
+func NewIPFilter(allow []string, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	if err := f.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Update atomically replaces the allow and deny lists of the filter. On error the previous lists are kept.
+func (f *IPFilter) Update(allow []string, deny []string) error {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return fmt.Errorf("invalid allow list: %w", err)
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return fmt.Errorf("invalid deny list: %w", err)
+	}
+	f.lists.Store(&ipFilterLists{allow: allowPrefixes, deny: denyPrefixes})
+	return nil
+}
+
+// Allowed returns whether connections from the given IP are allowed.
+func (f *IPFilter) Allowed(ip netip.Addr) bool {
+	lists := f.lists.Load()
+	if lists == nil {
+		return true
+	}
+	ip = ip.Unmap()
+	for _, prefix := range lists.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(lists.allow) == 0 {
+		return true
+	}
+	for _, prefix := range lists.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	for _, testCase := range []struct {
+		name    string
+		allow   []string
+		deny    []string
+		ip      string
+		allowed bool
+	}{
+		{"empty lists allow everything", nil, nil, "192.0.2.1", true},
+		{"denied CIDR", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"not denied", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"allowed CIDR", []string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"deny takes precedence", []string{"192.0.2.0/24"}, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{"single IP", []string{"2001:db8::1"}, nil, "2001:db8::1", true},
+		{"IPv4-mapped IPv6", []string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", true},
+		{"IPv6 CIDR", nil, []string{"2001:db8::/32"}, "2001:db8:1::1", false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			filter, err := conntrack.NewIPFilter(testCase.allow, testCase.deny)
+			require.NoError(t, err, "the filter lists must be valid")
+			assert.Equal(t, testCase.allowed, filter.Allowed(netip.MustParseAddr(testCase.ip)))
+		})
+	}
+}
+
+func TestIPFilterZeroValue(t *testing.T) {
+	filter := &conntrack.IPFilter{}
+	assert.True(t, filter.Allowed(netip.MustParseAddr("192.0.2.1")), "the zero value must allow every IP")
+	require.NoError(t, filter.Update(nil, []string{"192.0.2.0/24"}), "the filter lists must be valid")
+	assert.False(t, filter.Allowed(netip.MustParseAddr("192.0.2.1")), "the updated lists must apply")
+}
+
+func TestIPFilterInvalidUpdateKeepsLists(t *testing.T) {
+	filter, err := conntrack.NewIPFilter(nil, []string{"192.0.2.0/24"})
+	require.NoError(t, err, "the filter lists must be valid")
+	assert.Error(t, filter.Update(nil, []string{"not-an-ip"}), "invalid lists must be refused")
+	assert.False(t, filter.Allowed(netip.MustParseAddr("192.0.2.1")), "the previous lists must be kept")
+}
+
+func TestListenerIPFilter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	filter, err := conntrack.NewIPFilter(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err, "the filter lists must be valid")
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("ip_filter"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithTracing(),
+		conntrack.TrackWithIPFilter(filter))
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	deniedConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer deniedConn.Close()
+	require.NoError(t, deniedConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = deniedConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the denied connection must be closed by the listener")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_rejected_total", "ip_filter", "ip_filter"),
+		"the denied connection must be counted")
+	assert.Contains(t, fetchTraceEvents(t, "net.ServerConn.ip_filter"), deniedConn.LocalAddr().String(),
+		"the /debug/trace/events page must contain the rejected connection")
+
+	require.NoError(t, filter.Update([]string{"127.0.0.1"}, nil), "the filter lists must be valid")
+	allowedConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer allowedConn.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the connection allowed by the updated filter must be accepted")
+	}
+}
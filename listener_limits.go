@@ -0,0 +1,195 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// connLimiter limits the number of concurrently open connections of a listener, similar to `netutil.LimitListener`.
+type connLimiter struct {
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnLimiter(maxConns int) *connLimiter {
+	return &connLimiter{
+		sem:  make(chan struct{}, maxConns),
+		done: make(chan struct{}),
+	}
+}
+
+// acquire blocks until a connection slot is free or the limiter is closed, in which case it returns false.
+// The returned duration is the time spent waiting for the slot, zero if one was free straight away.
+func (l *connLimiter) acquire() (time.Duration, bool) {
+	select {
+	case <-l.done:
+		return 0, false
+	case l.sem <- struct{}{}:
+		return 0, true
+	default:
+	}
+	start := time.Now()
+	select {
+	case <-l.done:
+		return time.Since(start), false
+	case l.sem <- struct{}{}:
+		return time.Since(start), true
+	}
+}
+
+func (l *connLimiter) release() {
+	<-l.sem
+}
+
+func (l *connLimiter) close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+const (
+	rejectedPerIPLimit = "per_ip_limit"
+	rejectedPerIPRate  = "per_ip_rate"
+)
+
+const (
+	perIPSweepInterval = time.Minute
+)
+
+// perIPLimiter limits the simultaneous connections and the accept rate of each remote IP, or of each remote network
+// when a prefix length is configured. The accept rate is enforced with a token bucket per IP.
+type perIPLimiter struct {
+	maxConns int
+	rate     float64
+	burst    float64
+	v4Bits   int
+	v6Bits   int
+
+	mu        sync.Mutex
+	entries   map[netip.Prefix]*perIPEntry
+	lastSweep time.Time
+}
+
+type perIPEntry struct {
+	open       int
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newPerIPLimiter(opts *listenerOpts) *perIPLimiter {
+	return &perIPLimiter{
+		maxConns:  opts.maxConnsPerIP,
+		rate:      opts.acceptRatePerIP,
+		burst:     float64(opts.acceptBurstPerIP),
+		v4Bits:    opts.perIPv4PrefixLen,
+		v6Bits:    opts.perIPv6PrefixLen,
+		entries:   make(map[netip.Prefix]*perIPEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// admit decides whether a connection from the given remote address may be accepted. If it may, the returned func
+// must be called once the connection is closed. Otherwise, the reason of the rejection is returned.
+func (l *perIPLimiter) admit(remoteAddr net.Addr) (func(), string) {
+	key, ok := l.key(remoteAddr)
+	if !ok {
+		return func() {}, ""
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > perIPSweepInterval {
+		l.sweep(now)
+	}
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &perIPEntry{tokens: l.burst, lastRefill: now}
+		l.entries[key] = entry
+	}
+	if l.maxConns > 0 && entry.open >= l.maxConns {
+		return nil, rejectedPerIPLimit
+	}
+	if l.rate > 0 {
+		entry.refill(now, l.rate, l.burst)
+		if entry.tokens < 1 {
+			return nil, rejectedPerIPRate
+		}
+		entry.tokens--
+	}
+	entry.open++
+	return func() { l.release(key) }, ""
+}
+
+func (l *perIPLimiter) release(key netip.Prefix) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	entry.open--
+	if entry.open <= 0 && l.rate <= 0 {
+		delete(l.entries, key)
+	}
+}
+
+// sweep drops the entries without open connections whose token bucket is full again, as they carry no state.
+func (l *perIPLimiter) sweep(now time.Time) {
+	for key, entry := range l.entries {
+		if entry.open > 0 {
+			continue
+		}
+		entry.refill(now, l.rate, l.burst)
+		if entry.tokens >= l.burst {
+			delete(l.entries, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *perIPLimiter) key(remoteAddr net.Addr) (netip.Prefix, bool) {
+	addr, ok := remoteIP(remoteAddr)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits := l.v6Bits
+	if addr.Is4() {
+		bits = l.v4Bits
+	}
+	if bits <= 0 || bits > addr.BitLen() {
+		bits = addr.BitLen()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return prefix, true
+}
+
+func (e *perIPEntry) refill(now time.Time, rate float64, burst float64) {
+	e.tokens = math.Min(burst, e.tokens+now.Sub(e.lastRefill).Seconds()*rate)
+	e.lastRefill = now
+}
+
+// remoteIP returns the IP of the given remote address, without IPv4-mapping and zone. It returns false for addresses
+// that are not IP based, e.g. of unix sockets.
+func remoteIP(remoteAddr net.Addr) (netip.Addr, bool) {
+	var addr netip.Addr
+	if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+		addr = tcpAddr.AddrPort().Addr()
+	} else {
+		addrPort, err := netip.ParseAddrPort(remoteAddr.String())
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.Unmap().WithZone(""), addr.IsValid()
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerTcpKeepAliveWithProxyProtocol(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("keepalive_proxy"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithTcpKeepAlive(time.Second),
+		conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{TrustedUpstreams: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	_, err = clientConn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"))
+	require.NoError(t, err, "writing the header must succeed")
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection with a valid header must be accepted")
+	defer conn.Close()
+
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	require.NoError(t, err, "SyscallConn must be passed on")
+	var keepAlive, keepIdle int
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		keepAlive, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		keepIdle, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	}))
+	assert.Equal(t, 1, keepAlive, "keep-alive must be enabled on the socket behind the PROXY protocol header")
+	assert.Equal(t, 1, keepIdle, "the keep-alive period of the listener must be applied")
+}
@@ -4,48 +4,215 @@
 package conntrack
 
 import (
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-var (
-	listenerAcceptedTotal = promauto.NewCounterVec(
+const (
+	acceptFailedFdExhausted = "fd_exhausted"
+	acceptFailedAborted     = "aborted"
+	acceptFailedTimeout     = "timeout"
+	acceptFailedClosed      = "closed"
+	acceptFailedUnknown     = "unknown"
+)
+
+// acceptFailureReasons are the reasons an Accept call can fail for.
+var acceptFailureReasons = []string{acceptFailedFdExhausted, acceptFailedAborted, acceptFailedTimeout, acceptFailedClosed, acceptFailedUnknown}
+
+func (m *Metrics) initListenerMetrics(factory promauto.Factory, opts *metricsOpts) {
+	m.listenerAcceptedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_accepted_total",
+			Help:        "Total number of connections opened to the listener of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name"})
+
+	m.listenerClosedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_closed_total",
+			Help:        "Total number of connections closed that were made to the listener of a given name, by the reason they were closed for.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name", "closed_reason"})
+	m.listenerOpen = factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_open",
+			Help:        "Number of open connections to the listener of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name"})
+
+	m.listenerAcceptFailedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_accept_failed_total",
+			Help:        "Total number of failed Accept calls on the listener of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name", "reason", "temporary"})
+	m.listenerAcceptRetriesTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "listener_conn_accepted_total",
-			Help:      "Total number of connections opened to the listener of a given name.",
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_accept_retries_total",
+			Help:        "Total number of Accept calls retried after a temporary error on the listener of a given name.",
+			ConstLabels: opts.constLabels,
 		}, []string{"listener_name"})
 
-	listenerClosedTotal = promauto.NewCounterVec(
+	m.listenerThrottledTotal = factory.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "listener_conn_closed_total",
-			Help:      "Total number of connections closed that were made to the listener of a given name.",
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_throttled_total",
+			Help:        "Total number of Accept calls that had to wait for a free slot of the listener of a given name.",
+			ConstLabels: opts.constLabels,
 		}, []string{"listener_name"})
-	listenerOpen = promauto.NewGaugeVec(
+	m.listenerThrottledWait = factory.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "net",
-			Subsystem: "conntrack",
-			Name:      "listener_conn_open",
-			Help:      "Number of open connections to the listener of a given name.",
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_throttled_wait_seconds",
+			Help:        "Time in seconds the most recently throttled Accept call waited for a free slot of the listener of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name"})
+
+	m.listenerRejectedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_rejected_total",
+			Help:        "Total number of connections accepted and closed straight away by the listener of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name", "reason"})
+
+	m.listenerProxyProtocolFailedTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_proxy_protocol_failed_total",
+			Help:        "Total number of connections with a PROXY protocol header that couldn't be read by the listener of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name", "reason"})
+
+	m.listenerBytesReadTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_bytes_read_total",
+			Help:        "Total number of bytes read from connections made to the listener of a given name.",
+			ConstLabels: opts.constLabels,
+		}, []string{"listener_name"})
+	m.listenerBytesWrittenTotal = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_bytes_written_total",
+			Help:        "Total number of bytes written to connections made to the listener of a given name.",
+			ConstLabels: opts.constLabels,
 		}, []string{"listener_name"})
-)
+
+	m.listenerConnDuration = newConnDurationHistograms(
+		prometheus.HistogramOpts{
+			Namespace:   opts.namespace,
+			Subsystem:   opts.subsystem,
+			Name:        "listener_conn_duration_seconds",
+			Help:        "Duration in seconds of connections made to the listener of a given name, observed when they are closed.",
+			ConstLabels: opts.constLabels,
+		}, "listener_name")
+}
 
 // preRegisterListener pre-populates Prometheus labels for the given listener name, to avoid Prometheus missing labels issue.
-func preRegisterListenerMetrics(listenerName string) {
-	listenerAcceptedTotal.WithLabelValues(listenerName)
-	listenerClosedTotal.WithLabelValues(listenerName)
-	listenerOpen.WithLabelValues(listenerName)
+// The custom reasons of its error classifier are used for both the failed Accept calls and the closed connections.
+func (m *Metrics) preRegisterListenerMetrics(listenerName string, durationOpts durationHistogramOpts, customReasons []string) {
+	m.listenerConnDuration.withName(listenerName, durationOpts)
+	m.listenerAcceptedTotal.WithLabelValues(listenerName)
+	for _, reason := range slices.Concat(closeReasons, []string{closedMaxAge}, customReasons) {
+		m.listenerClosedTotal.WithLabelValues(listenerName, reason)
+	}
+	m.listenerOpen.WithLabelValues(listenerName)
+	for _, reason := range slices.Concat(acceptFailureReasons, customReasons) {
+		m.listenerAcceptFailedTotal.WithLabelValues(listenerName, reason, "true")
+		m.listenerAcceptFailedTotal.WithLabelValues(listenerName, reason, "false")
+	}
+	m.listenerAcceptRetriesTotal.WithLabelValues(listenerName)
+	m.listenerThrottledTotal.WithLabelValues(listenerName)
+	m.listenerThrottledWait.WithLabelValues(listenerName)
+	for _, reason := range []string{rejectedIPFilter, rejectedPerIPLimit, rejectedPerIPRate, rejectedProxyProtocol} {
+		m.listenerRejectedTotal.WithLabelValues(listenerName, reason)
+	}
+	for _, reason := range []string{proxyFailedTimeout, proxyFailedInvalid, proxyFailedRead} {
+		m.listenerProxyProtocolFailedTotal.WithLabelValues(listenerName, reason)
+	}
+	m.listenerBytesReadTotal.WithLabelValues(listenerName)
+	m.listenerBytesWrittenTotal.WithLabelValues(listenerName)
+}
+
+func (m *Metrics) reportListenerConnAccepted(listenerName string) {
+	m.listenerAcceptedTotal.WithLabelValues(listenerName).Inc()
+	m.listenerOpen.WithLabelValues(listenerName).Inc()
+}
+
+func (m *Metrics) reportListenerConnClosed(listenerName string, reason string, duration prometheus.Observer, openedAt time.Time) {
+	m.listenerClosedTotal.WithLabelValues(listenerName, reason).Inc()
+	m.listenerOpen.WithLabelValues(listenerName).Dec()
+	duration.Observe(time.Since(openedAt).Seconds())
+}
+
+func (m *Metrics) reportListenerAcceptFailed(listenerName string, reason string, temporary bool) {
+	m.listenerAcceptFailedTotal.WithLabelValues(listenerName, reason, strconv.FormatBool(temporary)).Inc()
+}
+
+func (m *Metrics) reportListenerAcceptRetry(listenerName string) {
+	m.listenerAcceptRetriesTotal.WithLabelValues(listenerName).Inc()
+}
+
+func (m *Metrics) reportListenerConnThrottled(listenerName string, waited time.Duration) {
+	m.listenerThrottledTotal.WithLabelValues(listenerName).Inc()
+	m.listenerThrottledWait.WithLabelValues(listenerName).Set(waited.Seconds())
+}
+
+func (m *Metrics) reportListenerConnRejected(listenerName string, reason string) {
+	m.listenerRejectedTotal.WithLabelValues(listenerName, reason).Inc()
+}
+
+func (m *Metrics) reportListenerProxyProtocolFailed(listenerName string, reason string) {
+	m.listenerProxyProtocolFailedTotal.WithLabelValues(listenerName, reason).Inc()
+}
+
+// acceptFailureReason classifies the given Accept error into one of the failure reasons.
+func acceptFailureReason(err error) string {
+	switch {
+	case errors.Is(err, net.ErrClosed):
+		return acceptFailedClosed
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return acceptFailedFdExhausted
+	case errors.Is(err, syscall.ECONNABORTED):
+		return acceptFailedAborted
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return acceptFailedTimeout
+	}
+	return acceptFailedUnknown
 }
 
-func reportListenerConnAccepted(listenerName string) {
-	listenerAcceptedTotal.WithLabelValues(listenerName).Inc()
-	listenerOpen.WithLabelValues(listenerName).Inc()
+// listenerConnDurationObserver returns the connection duration histogram of the given listener name.
+func (m *Metrics) listenerConnDurationObserver(listenerName string, durationOpts durationHistogramOpts) prometheus.Observer {
+	return m.listenerConnDuration.withName(listenerName, durationOpts)
 }
 
-func reportListenerConnClosed(listenerName string) {
-	listenerClosedTotal.WithLabelValues(listenerName).Inc()
-	listenerOpen.WithLabelValues(listenerName).Dec()
+// listenerConnBytesCounters returns the byte counters of the given listener name. They are resolved once per connection
+// so that accounting a Read or Write is a single atomic add.
+func (m *Metrics) listenerConnBytesCounters(listenerName string) (read prometheus.Counter, written prometheus.Counter) {
+	return m.listenerBytesReadTotal.WithLabelValues(listenerName), m.listenerBytesWrittenTotal.WithLabelValues(listenerName)
 }
@@ -4,15 +4,23 @@
 package conntrack_test
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"runtime"
+	"syscall"
 	"testing"
 
 	"context"
 
 	"time"
 
+	"github.com/jpillora/backoff"
 	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -48,6 +56,16 @@ func (s *ListenerTestSuite) SetupSuite() {
 	}()
 }
 
+// closeAndWaitForServer closes a client connection to the listener of the suite and waits for the server side to be
+// closed too. The http.Server closes its side in its own goroutine, so without waiting the close lands in the
+// counters of whichever test runs next.
+func (s *ListenerTestSuite) closeAndWaitForServer(conn net.Conn) {
+	conn.Close()
+	require.Eventually(s.T(), func() bool {
+		return sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_open", listenerName) == 0
+	}, time.Second, 5*time.Millisecond, "the server side of the connection must be closed")
+}
+
 func (s *ListenerTestSuite) TestTrackingMetricsPreregistered() {
 	// this will create the default listener, check if it is registered
 	conntrack.NewListener(s.serverListener)
@@ -62,6 +80,8 @@ func (s *ListenerTestSuite) TestTrackingMetricsPreregistered() {
 		{"net_conntrack_listener_conn_accepted_total", []string{listenerName}},
 		{"net_conntrack_listener_conn_closed_total", []string{listenerName}},
 		{"net_conntrack_listener_conn_open", []string{listenerName}},
+		{"net_conntrack_listener_conn_bytes_read_total", []string{listenerName}},
+		{"net_conntrack_listener_conn_bytes_written_total", []string{listenerName}},
 	} {
 		lineCount := len(fetchPrometheusLines(s.T(), testCase.metricName, testCase.existingLabels...))
 		assert.NotEqual(s.T(), 0, lineCount, "metrics must exist for test case %d", testId)
@@ -76,19 +96,42 @@ func (s *ListenerTestSuite) TestMonitoringNormalConns() {
 
 	conn, err := (&net.Dialer{}).DialContext(context.TODO(), "tcp", s.serverListener.Addr().String())
 	require.NoError(s.T(), err, "DialContext should successfully establish a conn here")
-	assert.Equal(s.T(), beforeAccepted+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_accepted_total", listenerName),
-		"the accepted conn counter must be incremented after connection was opened")
+	// The http.Server accepts and closes the server side in its own goroutine.
+	assert.Eventually(s.T(), func() bool {
+		return sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_accepted_total", listenerName) == beforeAccepted+1
+	}, time.Second, 5*time.Millisecond, "the accepted conn counter must be incremented after connection was opened")
 	assert.Equal(s.T(), beforeClosed, sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_closed_total", listenerName),
 		"the closed conn counter must not be incremented before the connection is closed")
 	assert.Equal(s.T(), beforeOpen+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_open", listenerName),
 		"the open conn must be incremented when the connection is opened")
 	conn.Close()
-	assert.Equal(s.T(), beforeClosed+1, sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_closed_total", listenerName),
-		"the closed conn counter must be incremented after connection was closed")
+	assert.Eventually(s.T(), func() bool {
+		return sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_closed_total", listenerName) == beforeClosed+1
+	}, time.Second, 5*time.Millisecond, "the closed conn counter must be incremented after connection was closed")
 	assert.Equal(s.T(), beforeOpen, sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_open", listenerName),
 		"the open conn must be decremented when the connection is closed")
 }
 
+func (s *ListenerTestSuite) TestMonitoringBytes() {
+	beforeRead := sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_bytes_read_total", listenerName)
+	beforeWritten := sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_bytes_written_total", listenerName)
+
+	conn, err := (&net.Dialer{}).DialContext(context.TODO(), "tcp", s.serverListener.Addr().String())
+	require.NoError(s.T(), err, "DialContext should successfully establish a conn here")
+	defer s.closeAndWaitForServer(conn)
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	_, err = conn.Write([]byte(request))
+	require.NoError(s.T(), err, "writing the request must succeed")
+	response := make([]byte, 1024)
+	n, err := conn.Read(response)
+	require.NoError(s.T(), err, "reading the response must succeed")
+
+	assert.Equal(s.T(), beforeRead+len(request), sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_bytes_read_total", listenerName),
+		"the bytes read counter must account for the request")
+	assert.Equal(s.T(), beforeWritten+n, sumCountersForMetricAndLabels(s.T(), "net_conntrack_listener_conn_bytes_written_total", listenerName),
+		"the bytes written counter must account for the response")
+}
+
 func (s *ListenerTestSuite) TestTracingNormalComms() {
 	conn, err := (&net.Dialer{}).DialContext(context.TODO(), "tcp", s.serverListener.Addr().String())
 	require.NoError(s.T(), err, "DialContext should successfully establish a conn here")
@@ -96,7 +139,7 @@ func (s *ListenerTestSuite) TestTracingNormalComms() {
 	assert.Contains(s.T(), fetchTraceEvents(s.T(), "net.ServerConn."+listenerName), conn.LocalAddr().String(),
 		"the /debug/trace/events page must contain the live connection")
 	time.Sleep(5 * time.Millisecond)
-	conn.Close()
+	s.closeAndWaitForServer(conn)
 }
 
 func (s *ListenerTestSuite) TearDownSuite() {
@@ -105,3 +148,567 @@ func (s *ListenerTestSuite) TearDownSuite() {
 		s.serverListener.Close()
 	}
 }
+
+// erroringListener returns the queued errors from Accept before delegating to the inner listener.
+type erroringListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *erroringListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+func TestListenerAcceptFailures(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	errs := make(chan error, 2)
+	errs <- &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	errs <- &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.ECONNABORTED)}
+	dialed := make(chan struct{})
+	listener := conntrack.NewListener(&erroringListener{Listener: inner, errs: errs},
+		conntrack.TrackWithName("accept_failures"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithRetries(backoff.Backoff{Min: time.Millisecond, Max: time.Millisecond}))
+
+	go func() {
+		defer close(dialed)
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	_, err = listener.Accept()
+	require.Error(t, err, "non-temporary accept errors must not be retried")
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the listener must keep accepting after an error")
+	conn.Close()
+	<-dialed
+	listener.Close()
+	_, err = listener.Accept()
+	require.Error(t, err, "accepting on a closed listener must fail")
+
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_accept_failed_total", "accept_failures", "fd_exhausted", "true"),
+		"running out of file descriptors must be counted")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_accept_failed_total", "accept_failures", "aborted", "false"),
+		"aborted connections must be counted")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_accept_failed_total", "accept_failures", "closed", "false"),
+		"accepting on a closed listener must be counted")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_accept_retries_total", "accept_failures"),
+		"the temporary error must have been retried")
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+func TestListenerErrorClassifier(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	errs := make(chan error, 2)
+	errs <- fmt.Errorf("accept: %w", errQuotaExceeded)
+	errs <- errors.New("something else")
+	listener := conntrack.NewListener(&erroringListener{Listener: inner, errs: errs},
+		conntrack.TrackWithName("error_classifier"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithErrorClassifier(func(err error) string {
+			switch {
+			case errors.Is(err, errQuotaExceeded):
+				return "quota"
+			case errors.Is(err, io.EOF):
+				return "client_gone"
+			}
+			return "not_allowed"
+		}, "quota", "client_gone"))
+	defer listener.Close()
+
+	assert.Len(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_listener_conn_closed_total", "error_classifier", "client_gone"), 1,
+		"the custom reasons must be pre-registered")
+	_, err = listener.Accept()
+	require.ErrorIs(t, err, errQuotaExceeded)
+	_, err = listener.Accept()
+	require.Error(t, err)
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_accept_failed_total", "error_classifier", "quota"),
+		"the accept error must be counted with the custom reason")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_accept_failed_total", "error_classifier", "unknown"),
+		"reasons that are not allowed must fall back to the built-in classification")
+	assert.Empty(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_listener_accept_failed_total", "not_allowed"),
+		"reasons that are not allowed must not be reported")
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	clientConn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "the peer must have closed the connection")
+	conn.Close()
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "error_classifier", "client_gone"),
+		"the close must be counted with the custom reason of the read error")
+}
+
+func TestListenerMaxConnections(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("max_conns"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithMaxConnections(1))
+	defer listener.Close()
+
+	for i := 0; i < 3; i++ {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err, "dialing the listener must succeed")
+		defer clientConn.Close()
+	}
+	first, err := listener.Accept()
+	require.NoError(t, err, "the first connection must be accepted")
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("Accept must block while the connection limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	first.Close()
+	select {
+	case second := <-accepted:
+		second.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Accept must resume once a tracked connection is closed")
+	}
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_throttled_total", "max_conns"),
+		"the throttled Accept must be counted")
+	assert.Len(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_listener_conn_throttled_wait_seconds", "max_conns"), 1,
+		"the wait time of the throttled Accept must be exported")
+
+	_, err = listener.Accept()
+	require.NoError(t, err, "the slot of a closed connection must be reusable")
+	errs := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		errs <- err
+	}()
+	listener.Close()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, net.ErrClosed, "closing the listener must unblock a throttled Accept")
+	case <-time.After(time.Second):
+		t.Fatal("closing the listener must unblock a throttled Accept")
+	}
+}
+
+func TestListenerPerIPLimits(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		track  func(inner net.Listener, name string, metrics *conntrack.Metrics) net.Listener
+		reason string
+	}{
+		{"per_ip_conns", func(inner net.Listener, name string, metrics *conntrack.Metrics) net.Listener {
+			return conntrack.NewListener(inner, conntrack.TrackWithName(name), conntrack.TrackWithMetrics(metrics),
+				conntrack.TrackWithMaxConnectionsPerIP(2))
+		}, "per_ip_limit"},
+		{"per_ip_rate", func(inner net.Listener, name string, metrics *conntrack.Metrics) net.Listener {
+			return conntrack.NewListener(inner, conntrack.TrackWithName(name), conntrack.TrackWithMetrics(metrics),
+				conntrack.TrackWithAcceptRatePerIP(0.001, 2))
+		}, "per_ip_rate"},
+		{"per_net_conns", func(inner net.Listener, name string, metrics *conntrack.Metrics) net.Listener {
+			return conntrack.NewListener(inner, conntrack.TrackWithName(name), conntrack.TrackWithMetrics(metrics),
+				conntrack.TrackWithMaxConnectionsPerIP(2), conntrack.TrackWithPerIPPrefixLength(8, 64))
+		}, "per_ip_limit"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err, "must be able to allocate a port")
+			listener := testCase.track(inner, testCase.name, conntrack.NewMetrics(reg))
+			defer listener.Close()
+
+			dialer := &net.Dialer{}
+			if testCase.name == "per_net_conns" {
+				// A different address of the same /8 network must share the limit.
+				dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+			}
+			for i := 0; i < 2; i++ {
+				clientConn, err := net.Dial("tcp", listener.Addr().String())
+				require.NoError(t, err, "dialing the listener must succeed")
+				defer clientConn.Close()
+				conn, err := listener.Accept()
+				require.NoError(t, err, "connections under the limit must be accepted")
+				defer conn.Close()
+			}
+
+			rejectedConn, err := dialer.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err, "dialing the listener must succeed")
+			defer rejectedConn.Close()
+			go func() {
+				if conn, err := listener.Accept(); err == nil {
+					conn.Close()
+				}
+			}()
+			require.NoError(t, rejectedConn.SetReadDeadline(time.Now().Add(time.Second)))
+			_, err = rejectedConn.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF, "the connection over the limit must be closed by the listener")
+			assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_rejected_total", testCase.name, testCase.reason),
+				"the rejected connection must be counted")
+			assert.Equal(t, 2, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_accepted_total", testCase.name),
+				"the rejected connection must not be counted as accepted")
+		})
+	}
+}
+
+func TestListenerDrain(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("drain"), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+
+	drained := make(chan error)
+	go func() {
+		drained <- listener.Drain(context.Background())
+	}()
+	select {
+	case <-drained:
+		t.Fatal("Drain must wait for the open connection to be closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = listener.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed, "a draining listener must not accept new connections")
+
+	conn.Close()
+	select {
+	case err := <-drained:
+		assert.NoError(t, err, "Drain must succeed once all connections are closed")
+	case <-time.After(time.Second):
+		t.Fatal("Drain must return once all connections are closed")
+	}
+}
+
+func TestListenerDrainForcesClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("drain"), conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, listener.Drain(ctx), context.DeadlineExceeded, "Drain must report that it had to close connections")
+	require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the remaining connection must be closed by Drain")
+}
+
+// blockingObserver holds up Accept in OnAccept until released, once it got a connection from the inner listener.
+type blockingObserver struct {
+	conntrack.NoopObserver
+	accepting chan struct{}
+	release   chan struct{}
+}
+
+func (o blockingObserver) OnAccept(ctx context.Context, _ *conntrack.ObservedConn) context.Context {
+	close(o.accepting)
+	<-o.release
+	return ctx
+}
+
+func TestListenerDrainDuringAccept(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	observer := blockingObserver{accepting: make(chan struct{}), release: make(chan struct{})}
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("drain_accept"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithObserver(observer))
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	accepted := make(chan error)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	<-observer.accepting
+	require.NoError(t, listener.Drain(context.Background()), "Drain must succeed without tracked connections")
+	close(observer.release)
+	assert.ErrorIs(t, <-accepted, net.ErrClosed, "Accept must not hand out a connection once Drain completed")
+	require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the connection accepted during Drain must be closed")
+}
+
+func TestListenerIdleTimeout(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("idle"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithIdleTimeout(100*time.Millisecond))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer conn.Close()
+
+	// Keep the connection busy for longer than the timeout.
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		_, err = clientConn.Write([]byte("ping"))
+		require.NoError(t, err, "writing must succeed")
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		require.NoError(t, err, "an active connection must not be closed")
+	}
+
+	require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the idle connection must be closed by the listener")
+	assert.Eventually(t, func() bool {
+		return sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "idle", "idle") == 1 &&
+			sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_open", "idle") == 0
+	}, time.Second, 5*time.Millisecond, "the close must be counted with the idle reason")
+}
+
+// closingObserver closes every accepted connection as soon as it is registered, while Accept may still be setting it
+// up, like a concurrent `Drain` or `DebugHandler` close would.
+type closingObserver struct {
+	conntrack.NoopObserver
+}
+
+func (closingObserver) OnAccept(ctx context.Context, conn *conntrack.ObservedConn) context.Context {
+	go func() {
+		for {
+			for _, info := range conntrack.Connections(conntrack.ConnFilter{Name: conn.Name}) {
+				if info.ID == conn.ID {
+					conn.Conn.Close()
+					return
+				}
+			}
+			runtime.Gosched()
+		}
+	}()
+	return ctx
+}
+
+func TestListenerTimersWithConcurrentClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("timers_close"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithIdleTimeout(time.Millisecond),
+		conntrack.TrackWithMaxConnectionAge(time.Millisecond, time.Millisecond),
+		conntrack.TrackWithObserver(closingObserver{}))
+	defer listener.Close()
+
+	for i := 0; i < 50; i++ {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err, "dialing the listener must succeed")
+		defer clientConn.Close()
+		_, err = listener.Accept()
+		require.NoError(t, err, "the connection must be accepted")
+	}
+	assert.Eventually(t, func() bool {
+		return len(conntrack.Connections(conntrack.ConnFilter{Name: "timers_close"})) == 0
+	}, time.Second, 5*time.Millisecond, "all connections must be closed")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, listener.Drain(ctx), "connections closed while being accepted must not be waited for by Drain")
+}
+
+func TestListenerMaxConnectionAge(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("max_age"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithMaxConnectionAge(50*time.Millisecond, 50*time.Millisecond))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer conn.Close()
+	openedAt := time.Now()
+
+	require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the connection must be closed by the listener once it is too old")
+	assert.GreaterOrEqual(t, time.Since(openedAt), 50*time.Millisecond, "the connection must be closed past its max age")
+	assert.Eventually(t, func() bool {
+		return sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "max_age", "max_age") == 1
+	}, time.Second, 5*time.Millisecond, "the close must be counted with the max_age reason")
+}
+
+func TestListenerMaxConnectionAgeWhenIdle(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("max_age_idle"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithMaxConnectionAge(20*time.Millisecond, 0),
+		conntrack.TrackWithMaxConnectionAgeWhenIdle(100*time.Millisecond))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	defer conn.Close()
+
+	// Keep the connection busy for well past its max age.
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		_, err = clientConn.Write([]byte("ping"))
+		require.NoError(t, err, "writing must succeed")
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		require.NoError(t, err, "a busy connection must not be closed")
+	}
+
+	require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the connection must be closed by the listener once it goes idle")
+	assert.Eventually(t, func() bool {
+		return sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "max_age_idle", "max_age") == 1
+	}, time.Second, 5*time.Millisecond, "the close must be counted with the max_age reason")
+}
+
+func TestListenerCloseReasons(t *testing.T) {
+	for _, testCase := range []struct {
+		reason string
+		// closeConn makes the connection accepted from the listener end up closed for the reason of the test case.
+		closeConn func(t *testing.T, listener conntrack.Listener, clientConn *net.TCPConn, conn net.Conn)
+	}{
+		{
+			reason: "local",
+			closeConn: func(t *testing.T, _ conntrack.Listener, _ *net.TCPConn, conn net.Conn) {
+				conn.Close()
+			},
+		},
+		{
+			reason: "remote_eof",
+			closeConn: func(t *testing.T, _ conntrack.Listener, clientConn *net.TCPConn, conn net.Conn) {
+				clientConn.Close()
+				_, err := conn.Read(make([]byte, 1))
+				require.ErrorIs(t, err, io.EOF, "the peer must have closed the connection")
+				conn.Close()
+			},
+		},
+		{
+			reason: "reset",
+			closeConn: func(t *testing.T, _ conntrack.Listener, clientConn *net.TCPConn, conn net.Conn) {
+				require.NoError(t, clientConn.SetLinger(0))
+				clientConn.Close()
+				_, err := conn.Read(make([]byte, 1))
+				require.ErrorIs(t, err, syscall.ECONNRESET, "the peer must have reset the connection")
+				conn.Close()
+			},
+		},
+		{
+			reason: "timeout",
+			closeConn: func(t *testing.T, _ conntrack.Listener, _ *net.TCPConn, conn net.Conn) {
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+				_, err := conn.Read(make([]byte, 1))
+				require.ErrorIs(t, err, os.ErrDeadlineExceeded, "the read deadline must be exceeded")
+				conn.Close()
+			},
+		},
+		{
+			reason: "forced",
+			closeConn: func(t *testing.T, listener conntrack.Listener, _ *net.TCPConn, _ net.Conn) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				require.ErrorIs(t, listener.Drain(ctx), context.Canceled, "Drain must close the connection forcefully")
+			},
+		},
+	} {
+		t.Run(testCase.reason, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err, "must be able to allocate a port")
+			listener := conntrack.NewListener(inner, conntrack.TrackWithName("close_reasons"), conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)))
+			defer listener.Close()
+
+			clientConn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err, "dialing the listener must succeed")
+			defer clientConn.Close()
+			conn, err := listener.Accept()
+			require.NoError(t, err, "the connection must be accepted")
+			defer conn.Close()
+
+			testCase.closeConn(t, listener, clientConn.(*net.TCPConn), conn)
+			assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "close_reasons", testCase.reason),
+				"the close must be counted with the %s reason", testCase.reason)
+			assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "close_reasons"),
+				"the close must be counted once")
+		})
+	}
+}
+
+func TestListenerCloseReasonWithHTTPKeepAlive(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("http_keep_alive"), conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)))
+	// net/http interrupts its background read with a past read deadline after every request it serves.
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.WriteString(resp, "pong")
+	})}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://" + listener.Addr().String())
+		require.NoError(t, err, "the request must succeed")
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err, "reading the response must succeed")
+		resp.Body.Close()
+	}
+	transport.CloseIdleConnections()
+
+	assert.Eventually(t, func() bool {
+		return sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "http_keep_alive") == 1
+	}, time.Second, 5*time.Millisecond, "the connection must be closed")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "http_keep_alive", "remote_eof"),
+		"the connection closed by the client must not be counted as timed out")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_accepted_total", "http_keep_alive"),
+		"the requests must have been served over a single connection")
+}
@@ -4,12 +4,17 @@
 package conntrack
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/jpillora/backoff"
+	"go.opentelemetry.io/otel/metric"
 	"golang.org/x/net/trace"
 )
 
@@ -22,7 +27,30 @@ type listenerOpts struct {
 	monitoring   bool
 	tracing      bool
 	tcpKeepAlive time.Duration
+	idleTimeout  time.Duration
 	retryBackoff *backoff.Backoff
+	metrics      *Metrics
+	duration     durationHistogramOpts
+	maxConns     int
+
+	maxConnAge        time.Duration
+	maxConnAgeJitter  time.Duration
+	maxConnAgeIdleFor time.Duration
+
+	maxConnsPerIP    int
+	acceptRatePerIP  float64
+	acceptBurstPerIP int
+	perIPv4PrefixLen int
+	perIPv6PrefixLen int
+	ipFilter         *IPFilter
+	proxyProtocol    *ProxyProtocolConfig
+
+	meterProvider   metric.MeterProvider
+	observers       []ConnObserver
+	errorClassifier *errorClassifier
+
+	// transferObservers are the observers notified of Reads and Writes, see `transferObservers`.
+	transferObservers []ConnObserver
 }
 
 type listenerOpt func(*listenerOpts)
@@ -41,6 +69,37 @@ func TrackWithoutMonitoring() listenerOpt {
 	}
 }
 
+// TrackWithMetrics makes the listener report to the given Metrics instead of `DefaultMetrics`.
+func TrackWithMetrics(m *Metrics) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.metrics = m
+	}
+}
+
+// TrackWithDurationBuckets overrides the buckets of the connection duration histogram of this listener.
+// The buckets of the first listener created with a given name are used for all listeners sharing that name.
+func TrackWithDurationBuckets(buckets []float64) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.duration.buckets = buckets
+	}
+}
+
+// TrackWithNativeDurationHistogram turns *on* the native (sparse) histogram for the connection duration of this
+// listener, using the given bucket growth factor (e.g. 1.1). Classic buckets keep being exposed alongside it.
+func TrackWithNativeDurationHistogram(bucketFactor float64) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.duration.nativeBucketFactor = bucketFactor
+	}
+}
+
+// TrackWithMeterProvider makes the listener report its metrics as OpenTelemetry instruments of the given provider too.
+// Use `TrackWithoutMonitoring` to report them to OpenTelemetry only.
+func TrackWithMeterProvider(provider metric.MeterProvider) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.meterProvider = provider
+	}
+}
+
 // TrackWithTracing turns *on* the /debug/events tracing of the live listener connections.
 func TrackWithTracing() listenerOpt {
 	return func(opts *listenerOpts) {
@@ -48,6 +107,22 @@ func TrackWithTracing() listenerOpt {
 	}
 }
 
+// TrackWithLogger makes the listener log accepted and closed connections as structured records to the given logger.
+// Use `LoggerWithLevel` to change the level of each event.
+func TrackWithLogger(logger *slog.Logger, optFuncs ...LoggerOpt) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.observers = append(opts.observers, NewSlogObserver(logger, optFuncs...))
+	}
+}
+
+// TrackWithObserver makes the listener notify the given observers of the connections it accepts, after the built-in
+// Prometheus, tracing and OpenTelemetry ones. It can be used more than once to add several observers.
+func TrackWithObserver(observers ...ConnObserver) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.observers = append(opts.observers, observers...)
+	}
+}
+
 // TrackWithRetries enables retrying of temporary Accept() errors, with the given backoff between attempts.
 // Concurrent accept calls that receive temporary errors have independent backoff scaling.
 func TrackWithRetries(b backoff.Backoff) listenerOpt {
@@ -56,6 +131,102 @@ func TrackWithRetries(b backoff.Backoff) listenerOpt {
 	}
 }
 
+// TrackWithMaxConnections limits the number of simultaneously open connections of this listener to n.
+// Once the limit is reached Accept blocks until one of the tracked connections is closed.
+// A value of 0 disables it.
+func TrackWithMaxConnections(n int) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.maxConns = n
+	}
+}
+
+// TrackWithMaxConnectionsPerIP limits the number of simultaneously open connections from a single remote IP to n.
+// Connections over the limit are closed straight away. See `TrackWithPerIPPrefixLength` to limit whole networks.
+// A value of 0 disables it.
+func TrackWithMaxConnectionsPerIP(n int) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.maxConnsPerIP = n
+	}
+}
+
+// TrackWithAcceptRatePerIP limits the rate of accepted connections from a single remote IP to ratePerSecond, allowing
+// bursts of up to burst connections. Connections over the rate are closed straight away.
+// A rate of 0 disables it.
+func TrackWithAcceptRatePerIP(ratePerSecond float64, burst int) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.acceptRatePerIP = ratePerSecond
+		opts.acceptBurstPerIP = max(burst, 1)
+	}
+}
+
+// TrackWithPerIPPrefixLength makes the per IP limits apply to whole networks of the given prefix lengths instead of
+// single addresses, e.g. 24 and 64 to treat every IPv4 /24 and IPv6 /64 as a single client.
+func TrackWithPerIPPrefixLength(ipv4Bits int, ipv6Bits int) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.perIPv4PrefixLen = ipv4Bits
+		opts.perIPv6PrefixLen = ipv6Bits
+	}
+}
+
+// TrackWithIPFilter makes the listener close connections from remote IPs that the given filter doesn't allow,
+// before they are returned from Accept. Keep a reference to the filter to update its lists at runtime.
+// Connections without a remote IP, e.g. over unix sockets, are not filtered.
+func TrackWithIPFilter(filter *IPFilter) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.ipFilter = filter
+	}
+}
+
+// TrackWithProxyProtocol makes the listener read PROXY protocol (v1 or v2) headers sent by the trusted upstreams of the
+// given config, e.g. HAProxy or AWS NLB. The `RemoteAddr` of the accepted connections then reports the original client,
+// which is also what IP filters and per IP limits apply to. Connections with an invalid header are closed straight away.
+// Use `ProxyHeaderFromConn` to access the header, including its TLVs.
+func TrackWithProxyProtocol(cfg ProxyProtocolConfig) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.proxyProtocol = &cfg
+	}
+}
+
+// TrackWithIdleTimeout makes the listener close connections on which no Read or Write happened for the given timeout,
+// like `http.Server.IdleTimeout` does for HTTP. Such closes are reported with the `idle` reason.
+// A value of 0 disables it.
+func TrackWithIdleTimeout(timeout time.Duration) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.idleTimeout = timeout
+	}
+}
+
+// TrackWithMaxConnectionAge makes the listener close connections once they are older than maxAge plus a random
+// duration of up to jitter, e.g. to have long-lived clients reconnect and get rebalanced across servers. Such closes
+// are reported with the `max_age` reason. See `TrackWithMaxConnectionAgeWhenIdle` to spare busy connections.
+// A value of 0 disables it.
+func TrackWithMaxConnectionAge(maxAge time.Duration, jitter time.Duration) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.maxConnAge = maxAge
+		opts.maxConnAgeJitter = jitter
+	}
+}
+
+// TrackWithMaxConnectionAgeWhenIdle makes the listener wait for connections past their max age to have gone the given
+// duration without a Read or Write before closing them, so that no request in flight is cut off.
+// Only applies together with `TrackWithMaxConnectionAge`.
+func TrackWithMaxConnectionAgeWhenIdle(idleFor time.Duration) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.maxConnAgeIdleFor = idleFor
+	}
+}
+
+// TrackWithErrorClassifier makes the listener classify errors with the given func before the built-in classification:
+// Accept errors into the `reason` of `listener_accept_failed_total`, and Read and Write errors into the reason
+// connections are closed for. The func must return one of the given reasons, a built-in one, or an empty string for
+// errors it doesn't recognize, which are passed on to the built-in classification. Other values are ignored the same
+// way, so that the cardinality of the metrics stays bounded.
+func TrackWithErrorClassifier(classifier func(err error) string, reasons ...string) listenerOpt {
+	return func(opts *listenerOpts) {
+		opts.errorClassifier = &errorClassifier{classify: classifier, reasons: reasons}
+	}
+}
+
 // TrackWithTcpKeepAlive makes sure that any `net.TCPConn` that get accepted have a keep-alive.
 // This is useful for HTTP servers in order for, for example laptops, to not use up resources on the
 // server while they don't utilise their connection.
@@ -66,86 +237,402 @@ func TrackWithTcpKeepAlive(keepalive time.Duration) listenerOpt {
 	}
 }
 
+// Listener is a `net.Listener` that tracks the connections it accepts, as returned by `NewListener`.
+type Listener interface {
+	net.Listener
+	// Drain stops accepting new connections and waits for all tracked connections of the listener to be closed.
+	// Once ctx is done, the remaining connections are closed forcefully and the error of ctx is returned.
+	// Connections accepted while draining are closed instead of being returned by Accept.
+	// This is meant for graceful restarts of services that don't have a shutdown mechanism like `http.Server.Shutdown`.
+	Drain(ctx context.Context) error
+}
+
 type connTrackListener struct {
 	net.Listener
-	opts *listenerOpts
+	opts    *listenerOpts
+	limiter *connLimiter
+	perIP   *perIPLimiter
+
+	conns   map[*serverConnTracker]struct{}
+	connsMu sync.Mutex
+	// draining is set once Drain started, after which Accept closes the connections it didn't track yet instead of
+	// returning them, since Drain couldn't see them.
+	draining bool
+
+	// event traces the listener itself, e.g. rejected connections, for as long as it isn't closed.
+	event   trace.EventLog
+	eventMu sync.Mutex
+
+	// proxyAccepted delivers the connections whose PROXY protocol header was read, see `acceptProxyProtocol`. Once
+	// the inner listener fails for good, acceptErr is set and acceptDone is closed. proxyPending holds a token for
+	// every connection accepted from the inner listener that wasn't delivered yet.
+	proxyAccepted     chan proxyAccepted
+	proxyPending      chan struct{}
+	startProxyAccepts sync.Once
+	acceptErr         error
+	acceptDone        chan struct{}
+	closed            chan struct{}
+	closeOnce         sync.Once
+}
+
+type proxyAccepted struct {
+	conn net.Conn
+	// releaseSlot frees the connection slot taken for the connection.
+	releaseSlot func()
+	err         error
 }
 
 // NewListener returns the given listener wrapped in connection tracking listener.
-func NewListener(inner net.Listener, optFuncs ...listenerOpt) net.Listener {
+func NewListener(inner net.Listener, optFuncs ...listenerOpt) Listener {
 	opts := &listenerOpts{
 		name:       defaultName,
 		monitoring: true,
 		tracing:    false,
+		metrics:    DefaultMetrics,
 	}
 	for _, f := range optFuncs {
 		f(opts)
 	}
+	var observers []ConnObserver
 	if opts.monitoring {
-		preRegisterListenerMetrics(opts.name)
+		opts.metrics.preRegisterListenerMetrics(opts.name, opts.duration, opts.errorClassifier.customReasons())
+		observers = append(observers, &prometheusObserver{metrics: opts.metrics, duration: opts.duration})
+	}
+	if opts.tracing {
+		observers = append(observers, NewEventLogObserver())
 	}
-	return &connTrackListener{
+	if opts.meterProvider != nil {
+		observers = append(observers, NewOTelMetricsObserver(opts.meterProvider))
+	}
+	opts.observers = append(observers, opts.observers...)
+	opts.transferObservers = transferObservers(opts.observers)
+	ct := &connTrackListener{
 		Listener: inner,
 		opts:     opts,
+		conns:    make(map[*serverConnTracker]struct{}),
+		closed:   make(chan struct{}),
+	}
+	if opts.proxyProtocol != nil {
+		maxPending := opts.proxyProtocol.MaxPending
+		if maxPending <= 0 {
+			maxPending = defaultProxyMaxPending
+		}
+		ct.proxyAccepted = make(chan proxyAccepted)
+		ct.proxyPending = make(chan struct{}, maxPending)
+		ct.acceptDone = make(chan struct{})
 	}
+	if opts.maxConns > 0 {
+		ct.limiter = newConnLimiter(opts.maxConns)
+	}
+	if opts.maxConnsPerIP > 0 || opts.acceptRatePerIP > 0 {
+		ct.perIP = newPerIPLimiter(opts)
+	}
+	if opts.tracing {
+		ct.event = trace.NewEventLog(fmt.Sprintf("net.ServerConn.%s", opts.name), fmt.Sprintf("listener %v", inner.Addr()))
+	}
+	return ct
 }
 
 func (ct *connTrackListener) Accept() (net.Conn, error) {
-	// TODO(mwitkow): Add monitoring of failed accept.
 	var (
-		conn net.Conn
-		err  error
+		conn        net.Conn
+		releaseSlot func()
+		releaseIP   func()
+		err         error
 	)
-	for attempt := 0; ; attempt++ {
-		conn, err = ct.Listener.Accept()
-		if err == nil || ct.opts.retryBackoff == nil {
-			break
+	for {
+		conn, releaseSlot, err = ct.nextConn()
+		if err != nil {
+			return nil, err
 		}
-		if t, ok := err.(interface{ Temporary() bool }); !ok || !t.Temporary() {
+		if releaseIP = ct.admit(conn); releaseIP != nil {
 			break
 		}
-		time.Sleep(ct.opts.retryBackoff.ForAttempt(float64(attempt)))
+		releaseSlot()
 	}
-	if err != nil {
-		return nil, err
+	release := func() {
+		releaseIP()
+		releaseSlot()
 	}
-	if tcpConn, ok := conn.(*net.TCPConn); ok && ct.opts.tcpKeepAlive > 0 {
+	// Connections that had their PROXY protocol header read are wrapped, the keep-alive applies to their socket.
+	if tcpConn, ok := Unwrap(conn).(*net.TCPConn); ok && ct.opts.tcpKeepAlive > 0 {
 		if err := tcpConn.SetKeepAlive(true); err != nil {
+			conn.Close()
+			release()
 			return nil, fmt.Errorf("failed to enable keep alive: %w", err)
 		}
 
 		if err := tcpConn.SetKeepAlivePeriod(ct.opts.tcpKeepAlive); err != nil {
+			conn.Close()
+			release()
 			return nil, fmt.Errorf("failed to set keep alive period: %w", err)
 		}
 	}
-	return newServerConnTracker(conn, ct.opts), nil
+	var tracker *serverConnTracker
+	tracker = newServerConnTracker(conn, ct.Addr(), ct.opts, func() {
+		ct.untrack(tracker)
+		release()
+	})
+	if !ct.track(tracker) {
+		tracker.closeWithReason(tracker, closedForced)
+		return nil, net.ErrClosed
+	}
+	if tracker.closed.Load() {
+		// The connection was closed through the registry or by an observer before being tracked, so its untrack came
+		// first and Drain would wait for it forever.
+		ct.untrack(tracker)
+	}
+	tracker.startTimers()
+	return withOptionalInterfaces(tracker), nil
 }
 
-type serverConnTracker struct {
-	net.Conn
-	opts  *listenerOpts
-	event trace.EventLog
-	mu    sync.Mutex
+// nextConn returns the next accepted connection, with its PROXY protocol header read if the listener expects one.
+// The returned func frees the connection slot taken for it.
+func (ct *connTrackListener) nextConn() (net.Conn, func(), error) {
+	if ct.opts.proxyProtocol == nil {
+		return ct.acceptConn()
+	}
+	ct.startProxyAccepts.Do(func() {
+		go ct.acceptProxyProtocol()
+	})
+	select {
+	case accepted := <-ct.proxyAccepted:
+		return accepted.conn, accepted.releaseSlot, accepted.err
+	case <-ct.acceptDone:
+		return nil, nil, ct.acceptErr
+	}
 }
 
-func newServerConnTracker(inner net.Conn, opts *listenerOpts) net.Conn {
-	tracker := &serverConnTracker{
-		Conn: inner,
-		opts: opts,
+// acceptConn accepts a connection from the inner listener once a connection slot is free. The returned func frees
+// the slot.
+func (ct *connTrackListener) acceptConn() (net.Conn, func(), error) {
+	releaseSlot := func() {}
+	if ct.limiter != nil {
+		waited, ok := ct.limiter.acquire()
+		if waited > 0 && ct.opts.monitoring {
+			ct.opts.metrics.reportListenerConnThrottled(ct.opts.name, waited)
+		}
+		if !ok {
+			return nil, nil, net.ErrClosed
+		}
+		releaseSlot = ct.limiter.release
 	}
-	if opts.tracing {
-		tracker.event = trace.NewEventLog(fmt.Sprintf("net.ServerConn.%s", opts.name), fmt.Sprintf("%v", inner.RemoteAddr()))
-		tracker.event.Printf("accepted: %v -> %v", inner.RemoteAddr(), inner.LocalAddr())
+	conn, err := ct.acceptWithRetries()
+	if err != nil {
+		releaseSlot()
+		return nil, nil, err
 	}
-	if opts.monitoring {
-		reportListenerConnAccepted(opts.name)
+	return conn, releaseSlot, nil
+}
+
+// acceptProxyProtocol accepts connections until the inner listener fails for good, reading the PROXY protocol header
+// of each of them in its own goroutine, so that a peer stalling on its header doesn't hold up the others. Connections
+// are handed over to Accept once their header is read. At most `MaxPending` connections are accepted ahead of Accept.
+func (ct *connTrackListener) acceptProxyProtocol() {
+	for {
+		select {
+		case ct.proxyPending <- struct{}{}:
+		case <-ct.closed:
+			ct.acceptErr = net.ErrClosed
+			close(ct.acceptDone)
+			return
+		}
+		conn, releaseSlot, err := ct.acceptConn()
+		if err != nil {
+			if t, ok := err.(interface{ Temporary() bool }); ok && t.Temporary() {
+				ct.deliverProxyAccepted(proxyAccepted{err: err})
+				continue
+			}
+			<-ct.proxyPending
+			ct.acceptErr = err
+			close(ct.acceptDone)
+			return
+		}
+		go func() {
+			if conn := ct.readProxyHeader(conn); conn != nil {
+				ct.deliverProxyAccepted(proxyAccepted{conn: conn, releaseSlot: releaseSlot})
+			} else {
+				releaseSlot()
+				<-ct.proxyPending
+			}
+		}()
 	}
-	return tracker
 }
 
-func (ct *serverConnTracker) Close() error {
-	err := ct.Conn.Close()
-	ct.mu.Lock()
+// deliverProxyAccepted hands the given connection or error over to Accept, closing the connection instead if the
+// listener gets closed first. Either way, the pending token taken for it is returned.
+func (ct *connTrackListener) deliverProxyAccepted(accepted proxyAccepted) {
+	defer func() { <-ct.proxyPending }()
+	select {
+	case ct.proxyAccepted <- accepted:
+	case <-ct.closed:
+		if accepted.conn != nil {
+			accepted.conn.Close()
+			accepted.releaseSlot()
+		}
+	}
+}
+
+// readProxyHeader reads the PROXY protocol header of the freshly accepted connection if it comes from a trusted
+// upstream. Connections with an invalid header are closed and accounted for, in which case nil is returned.
+func (ct *connTrackListener) readProxyHeader(conn net.Conn) net.Conn {
+	if ct.opts.proxyProtocol == nil {
+		return conn
+	}
+	if len(ct.opts.proxyProtocol.TrustedUpstreams) == 0 {
+		ct.eventMu.Lock()
+		if ct.event != nil {
+			ct.event.Errorf("no trusted upstreams to read PROXY protocol headers from")
+		}
+		ct.eventMu.Unlock()
+		ct.reject(conn, rejectedProxyProtocol)
+		return nil
+	}
+	if !ct.opts.proxyProtocol.trustsUpstream(conn.RemoteAddr()) {
+		return conn
+	}
+	proxyConn, reason, err := ct.opts.proxyProtocol.readProxyHeader(conn)
+	if err == nil {
+		return proxyConn
+	}
+	if ct.opts.monitoring {
+		ct.opts.metrics.reportListenerProxyProtocolFailed(ct.opts.name, reason)
+	}
+	ct.eventMu.Lock()
+	if ct.event != nil {
+		ct.event.Errorf("failed reading PROXY protocol header from %v: %v", conn.RemoteAddr(), err)
+	}
+	ct.eventMu.Unlock()
+	ct.reject(conn, rejectedProxyProtocol)
+	return nil
+}
+
+// admit applies the IP filter and the per IP limits to the freshly accepted connection. Rejected connections are
+// closed and accounted for, in which case nil is returned. Otherwise, the returned func must be called once the
+// connection is closed.
+func (ct *connTrackListener) admit(conn net.Conn) func() {
+	if ct.opts.ipFilter != nil {
+		if ip, ok := remoteIP(conn.RemoteAddr()); ok && !ct.opts.ipFilter.Allowed(ip) {
+			ct.reject(conn, rejectedIPFilter)
+			return nil
+		}
+	}
+	if ct.perIP == nil {
+		return func() {}
+	}
+	release, reason := ct.perIP.admit(conn.RemoteAddr())
+	if release != nil {
+		return release
+	}
+	ct.reject(conn, reason)
+	return nil
+}
+
+func (ct *connTrackListener) reject(conn net.Conn, reason string) {
+	ct.eventMu.Lock()
+	if ct.event != nil {
+		ct.event.Errorf("rejected (%s): %v -> %v", reason, conn.RemoteAddr(), conn.LocalAddr())
+	}
+	ct.eventMu.Unlock()
+	if ct.opts.monitoring {
+		ct.opts.metrics.reportListenerConnRejected(ct.opts.name, reason)
+	}
+	conn.Close()
+}
+
+func (ct *connTrackListener) acceptWithRetries() (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := ct.Listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		t, ok := err.(interface{ Temporary() bool })
+		temporary := ok && t.Temporary()
+		if ct.opts.monitoring {
+			ct.opts.metrics.reportListenerAcceptFailed(ct.opts.name, ct.opts.errorClassifier.acceptFailureReason(err), temporary)
+		}
+		if ct.opts.retryBackoff == nil || !temporary {
+			return nil, err
+		}
+		if ct.opts.monitoring {
+			ct.opts.metrics.reportListenerAcceptRetry(ct.opts.name)
+		}
+		time.Sleep(ct.opts.retryBackoff.ForAttempt(float64(attempt)))
+	}
+}
+
+// track adds the given connection to the open ones of the listener, unless the listener is draining.
+func (ct *connTrackListener) track(tracker *serverConnTracker) bool {
+	ct.connsMu.Lock()
+	defer ct.connsMu.Unlock()
+	if ct.draining {
+		return false
+	}
+	ct.conns[tracker] = struct{}{}
+	return true
+}
+
+func (ct *connTrackListener) untrack(tracker *serverConnTracker) {
+	ct.connsMu.Lock()
+	delete(ct.conns, tracker)
+	ct.connsMu.Unlock()
+}
+
+func (ct *connTrackListener) openConns() []*serverConnTracker {
+	ct.connsMu.Lock()
+	defer ct.connsMu.Unlock()
+	conns := make([]*serverConnTracker, 0, len(ct.conns))
+	for tracker := range ct.conns {
+		conns = append(conns, tracker)
+	}
+	return conns
+}
+
+const drainPollIntervalMax = 500 * time.Millisecond
+
+func (ct *connTrackListener) Drain(ctx context.Context) error {
+	ct.connsMu.Lock()
+	ct.draining = true
+	draining := len(ct.conns)
+	ct.connsMu.Unlock()
+	ct.eventMu.Lock()
+	if ct.event != nil {
+		ct.event.Printf("draining %d connections", draining)
+	}
+	ct.eventMu.Unlock()
+	if err := ct.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	// Like `http.Server.Shutdown`, poll with an exponential backoff for the connections to be closed.
+	pollInterval := time.Millisecond
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+	for {
+		if len(ct.openConns()) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, tracker := range ct.openConns() {
+				tracker.closeWithReason(tracker, closedForced)
+			}
+			return ctx.Err()
+		case <-timer.C:
+			pollInterval = min(2*pollInterval, drainPollIntervalMax)
+			timer.Reset(pollInterval)
+		}
+	}
+}
+
+func (ct *connTrackListener) Close() error {
+	if ct.limiter != nil {
+		ct.limiter.close()
+	}
+	ct.closeOnce.Do(func() {
+		close(ct.closed)
+	})
+	err := ct.Listener.Close()
+	ct.eventMu.Lock()
 	if ct.event != nil {
 		if err != nil {
 			ct.event.Errorf("failed closing: %v", err)
@@ -155,9 +642,87 @@ func (ct *serverConnTracker) Close() error {
 		ct.event.Finish()
 		ct.event = nil
 	}
-	ct.mu.Unlock()
-	if ct.opts.monitoring {
-		reportListenerConnClosed(ct.opts.name)
+	ct.eventMu.Unlock()
+	return err
+}
+
+type serverConnTracker struct {
+	net.Conn
+	connStats
+	opts *listenerOpts
+
+	// release frees the resources held for the connection by the listener, e.g. its connection slot.
+	release func()
+}
+
+func newServerConnTracker(inner net.Conn, listenerAddr net.Addr, opts *listenerOpts, release func()) *serverConnTracker {
+	tracker := &serverConnTracker{
+		Conn:    inner,
+		opts:    opts,
+		release: release,
+	}
+	tracker.connStats.init(tracker, ConnKindListener, opts.name)
+	tracker.errorClassifier = opts.errorClassifier
+	tracker.transferObservers = opts.transferObservers
+	tracker.observed.ListenerAddr = listenerAddr
+	tracker.observe(context.Background(), opts.observers, func(ctx context.Context, observer ConnObserver) context.Context {
+		return observer.OnAccept(ctx, &tracker.observed)
+	})
+	registry.register(tracker)
+	return tracker
+}
+
+// startTimers starts closing the connection on the timeouts of the listener. This must happen once the connection is
+// fully set up, since it may get closed straight away.
+func (ct *serverConnTracker) startTimers() {
+	if ct.opts.idleTimeout > 0 {
+		ct.watchIdle(ct, ct.opts.idleTimeout)
 	}
+	if ct.opts.maxConnAge > 0 {
+		ct.watchMaxAge(ct, ct.opts.maxConnAge, ct.opts.maxConnAgeJitter, ct.opts.maxConnAgeIdleFor)
+	}
+}
+
+func (ct *serverConnTracker) stats() *connStats {
+	return &ct.connStats
+}
+
+func (ct *serverConnTracker) innerConn() net.Conn {
+	return ct.Conn
+}
+
+func (ct *serverConnTracker) Read(b []byte) (int, error) {
+	n, err := ct.Conn.Read(b)
+	ct.onRead(n, err)
+	return n, err
+}
+
+func (ct *serverConnTracker) Write(b []byte) (int, error) {
+	n, err := ct.Conn.Write(b)
+	ct.onWrite(n, err)
+	return n, err
+}
+
+// ReadFrom implements `io.ReaderFrom`, keeping the zero-copy transfers of the inner connection for `io.Copy`.
+func (ct *serverConnTracker) ReadFrom(r io.Reader) (int64, error) {
+	return ct.readFrom(ct.Conn, r)
+}
+
+// WriteTo implements `io.WriterTo`, keeping the zero-copy transfers of the inner connection for `io.Copy`.
+func (ct *serverConnTracker) WriteTo(w io.Writer) (int64, error) {
+	return ct.writeTo(ct, ct.Conn, w)
+}
+
+func (ct *serverConnTracker) Close() error {
+	if !ct.closed.CompareAndSwap(false, true) {
+		// Servers and TLS layers routinely close connections more than once, only the first Close is accounted for.
+		return ct.Conn.Close()
+	}
+	ct.stopTimers()
+	err := ct.Conn.Close()
+	reason := ct.closedReason()
+	registry.unregister(ct)
+	ct.release()
+	ct.onClose(reason, err)
 	return err
 }
@@ -0,0 +1,178 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultMetricsNamespace = "net"
+	defaultMetricsSubsystem = "conntrack"
+)
+
+var (
+	// defaultConnDurationBuckets span from short lived health checks up to connections that are held for a day.
+	defaultConnDurationBuckets = []float64{0.01, 0.1, 1, 10, 60, 300, 900, 1800, 3600, 3 * 3600, 12 * 3600, 24 * 3600}
+)
+
+// DefaultMetrics is the Metrics instance registered with the Prometheus default registerer. It is used by
+// listeners and dialers that were not given their own instance with `TrackWithMetrics` or `DialWithMetrics`.
+var DefaultMetrics = NewMetrics(prometheus.DefaultRegisterer)
+
+type metricsOpts struct {
+	namespace   string
+	subsystem   string
+	constLabels prometheus.Labels
+}
+
+// MetricsOpt defines a config option you can set on Metrics.
+type MetricsOpt func(*metricsOpts)
+
+// MetricsWithNamespace overrides the namespace of all metric names (default is `net`).
+func MetricsWithNamespace(namespace string) MetricsOpt {
+	return func(opts *metricsOpts) {
+		opts.namespace = namespace
+	}
+}
+
+// MetricsWithSubsystem overrides the subsystem of all metric names (default is `conntrack`).
+func MetricsWithSubsystem(subsystem string) MetricsOpt {
+	return func(opts *metricsOpts) {
+		opts.subsystem = subsystem
+	}
+}
+
+// MetricsWithConstLabels attaches the given constant labels to all metrics.
+func MetricsWithConstLabels(labels prometheus.Labels) MetricsOpt {
+	return func(opts *metricsOpts) {
+		opts.constLabels = labels
+	}
+}
+
+// Metrics holds the Prometheus collectors used for monitoring of listeners and dialers.
+type Metrics struct {
+	listenerAcceptedTotal *prometheus.CounterVec
+	listenerClosedTotal   *prometheus.CounterVec
+	listenerOpen          *prometheus.GaugeVec
+
+	listenerAcceptFailedTotal  *prometheus.CounterVec
+	listenerAcceptRetriesTotal *prometheus.CounterVec
+	listenerThrottledTotal     *prometheus.CounterVec
+	listenerThrottledWait      *prometheus.GaugeVec
+	listenerRejectedTotal      *prometheus.CounterVec
+
+	listenerProxyProtocolFailedTotal *prometheus.CounterVec
+
+	listenerBytesReadTotal    *prometheus.CounterVec
+	listenerBytesWrittenTotal *prometheus.CounterVec
+
+	dialerAttemptedTotal       *prometheus.CounterVec
+	dialerRetriesTotal         *prometheus.CounterVec
+	dialerCircuitBreakerState  *prometheus.GaugeVec
+	dialerConnEstablishedTotal *prometheus.CounterVec
+	dialerConnFailedTotal      *prometheus.CounterVec
+	dialerConnClosedTotal      *prometheus.CounterVec
+	dialerConnOpen             *prometheus.GaugeVec
+	dialerDialDuration         *prometheus.HistogramVec
+
+	dialerConnBytesReadTotal    *prometheus.CounterVec
+	dialerConnBytesWrittenTotal *prometheus.CounterVec
+
+	listenerConnDuration *connDurationHistograms
+	dialerConnDuration   *connDurationHistograms
+}
+
+// NewMetrics creates the connection tracking collectors and registers them with the given registerer.
+// A nil registerer leaves the collectors unregistered. As with `promauto`, registration failures panic.
+func NewMetrics(reg prometheus.Registerer, optFuncs ...MetricsOpt) *Metrics {
+	opts := &metricsOpts{
+		namespace: defaultMetricsNamespace,
+		subsystem: defaultMetricsSubsystem,
+	}
+	for _, f := range optFuncs {
+		f(opts)
+	}
+	m := &Metrics{}
+	factory := promauto.With(reg)
+	m.initListenerMetrics(factory, opts)
+	m.initDialerMetrics(factory, opts)
+	if reg != nil {
+		reg.MustRegister(m.listenerConnDuration, m.dialerConnDuration)
+	}
+	return m
+}
+
+type durationHistogramOpts struct {
+	buckets            []float64
+	nativeBucketFactor float64
+}
+
+// connDurationHistograms is a collector of connection duration histograms keyed by listener or dialer name. Unlike a
+// `prometheus.HistogramVec` it allows every name to use its own bucket layout, which is configured on the listener or
+// dialer rather than on Metrics.
+type connDurationHistograms struct {
+	opts       prometheus.HistogramOpts
+	labelName  string
+	mu         sync.RWMutex
+	histograms map[string]prometheus.Histogram
+}
+
+func newConnDurationHistograms(opts prometheus.HistogramOpts, labelName string) *connDurationHistograms {
+	return &connDurationHistograms{
+		opts:       opts,
+		labelName:  labelName,
+		histograms: make(map[string]prometheus.Histogram),
+	}
+}
+
+// Describe intentionally sends no descriptors, which makes this an unchecked collector. The histograms are created
+// lazily with per-name buckets, so they can't be described upfront.
+func (h *connDurationHistograms) Describe(chan<- *prometheus.Desc) {}
+
+func (h *connDurationHistograms) Collect(ch chan<- prometheus.Metric) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, histogram := range h.histograms {
+		histogram.Collect(ch)
+	}
+}
+
+// withName returns the histogram of the given name, creating it with the given options if needed. The options of the
+// first listener or dialer using a name win.
+func (h *connDurationHistograms) withName(name string, durationOpts durationHistogramOpts) prometheus.Histogram {
+	h.mu.RLock()
+	histogram, ok := h.histograms[name]
+	h.mu.RUnlock()
+	if ok {
+		return histogram
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if histogram, ok := h.histograms[name]; ok {
+		return histogram
+	}
+	opts := h.opts
+	opts.ConstLabels = prometheus.Labels{h.labelName: name}
+	for k, v := range h.opts.ConstLabels {
+		opts.ConstLabels[k] = v
+	}
+	opts.Buckets = durationOpts.buckets
+	if opts.Buckets == nil {
+		opts.Buckets = defaultConnDurationBuckets
+	}
+	if durationOpts.nativeBucketFactor > 1 {
+		opts.NativeHistogramBucketFactor = durationOpts.nativeBucketFactor
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	histogram = prometheus.NewHistogram(opts)
+	h.histograms[name] = histogram
+	return histogram
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsAreIsolatedPerRegistry(t *testing.T) {
+	regA := prometheus.NewRegistry()
+	regB := prometheus.NewRegistry()
+	metricsA := conntrack.NewMetrics(regA)
+	metricsB := conntrack.NewMetrics(regB, conntrack.MetricsWithNamespace("other"), conntrack.MetricsWithSubsystem("tracking"))
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithName("isolated"), conntrack.TrackWithMetrics(metricsA))
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("isolated"), conntrack.DialWithMetrics(metricsB))
+	conn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return sumCountersForMetricAndLabelsFrom(t, regA, "net_conntrack_listener_conn_closed_total", "isolated") == 1
+	}, time.Second, 5*time.Millisecond, "listener metrics must be reported to its own registry")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, regB, "other_tracking_dialer_conn_established_total", "isolated"),
+		"dialer metrics must be reported to its own registry using the configured namespace and subsystem")
+	assert.Empty(t, fetchPrometheusLinesFrom(t, regA, "net_conntrack_dialer_conn_attempted_total", "isolated"),
+		"dialer metrics must not leak into the listener registry")
+	assert.Empty(t, fetchPrometheusLines(t, "net_conntrack_listener_conn_accepted_total", "isolated"),
+		"metrics must not leak into the default registry")
+}
+
+func TestMetricsWithConstLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := conntrack.NewMetrics(reg, conntrack.MetricsWithConstLabels(prometheus.Labels{"instance_role": "frontend"}))
+	metrics.PreRegisterDialerMetrics("const_labels")
+
+	assert.NotEmpty(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_dialer_conn_attempted_total", "const_labels", "frontend"),
+		"const labels must be attached to the metrics")
+}
+
+func TestMetricsCanBeCreatedTwiceWithoutRegisterer(t *testing.T) {
+	assert.NotPanics(t, func() {
+		conntrack.NewMetrics(nil)
+		conntrack.NewMetrics(nil)
+	}, "unregistered metrics must not conflict with each other")
+}
+
+func TestMetricsConnDurationHistograms(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := conntrack.NewMetrics(reg)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("durations"),
+		conntrack.TrackWithMetrics(metrics),
+		conntrack.TrackWithDurationBuckets([]float64{0.25, 42}),
+		conntrack.TrackWithNativeDurationHistogram(1.1))
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dialFunc := conntrack.NewDialContextFunc(conntrack.DialWithName("durations"), conntrack.DialWithMetrics(metrics))
+	conn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_duration_seconds_count", "durations") == 1
+	}, time.Second, 5*time.Millisecond, "the listener conn duration must be observed on close")
+	assert.Len(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_listener_conn_duration_seconds_bucket", "durations"), 3,
+		"the listener histogram must use the configured buckets")
+	assert.NotEmpty(t, fetchPrometheusLinesFrom(t, reg, "net_conntrack_listener_conn_duration_seconds_bucket", "durations", "42"),
+		"the listener histogram must use the configured buckets")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_dialer_conn_duration_seconds_count", "durations"),
+		"the dialer conn duration must be observed on close")
+
+	families, err := reg.Gather()
+	require.NoError(t, err, "gathering metrics must succeed")
+	for _, family := range families {
+		if family.GetName() != "net_conntrack_listener_conn_duration_seconds" {
+			continue
+		}
+		require.Len(t, family.GetMetric(), 1, "there must be a single listener histogram")
+		assert.NotNil(t, family.GetMetric()[0].GetHistogram().Schema, "the listener histogram must be a native histogram")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ConnObserver is notified of the lifecycle of the connections of a listener or a dialer, see `TrackWithObserver` and
+// `DialWithObserver`. Prometheus monitoring, /debug/events tracing, OpenTelemetry and logging are all observers, see
+// `NewPrometheusObserver`, `NewEventLogObserver`, `NewOTelMetricsObserver`, `NewOTelTracingObserver` and
+// `NewSlogObserver`.
+//
+// The hooks are called synchronously, on the hot path for OnRead and OnWrite, so they must be cheap and must not
+// block. The context returned by OnAccept and OnDialDone is passed to all the later hooks of the connection, which lets
+// observers keep their per connection state in its values, the way `context.WithValue` is meant for.
+type ConnObserver interface {
+	// OnAccept is called once a listener accepted a connection, before it is returned from Accept.
+	OnAccept(ctx context.Context, conn *ObservedConn) context.Context
+	// OnDialStart is called before dialing. The returned context is used for the dial and passed on to OnDialDone.
+	OnDialStart(ctx context.Context, dial *DialInfo) context.Context
+	// OnDialDone is called once a dial is done. If it failed, conn is nil and the returned context is discarded.
+	OnDialDone(ctx context.Context, dial *DialInfo, conn *ObservedConn, err error) context.Context
+	// OnRead is called after every Read of the connection, as well as after the transfers of `io.Copy`.
+	OnRead(ctx context.Context, conn *ObservedConn, n int, err error)
+	// OnWrite is called after every Write of the connection, as well as after the transfers of `io.Copy`.
+	OnWrite(ctx context.Context, conn *ObservedConn, n int, err error)
+	// OnClose is called once, when the connection is closed for the given reason, e.g. `local` or `idle`, with the
+	// error returned by Close.
+	OnClose(ctx context.Context, conn *ObservedConn, reason string, err error)
+}
+
+// ObservedConn is a tracked connection, as seen by the hooks of `ConnObserver`.
+type ObservedConn struct {
+	// ID identifies the connection, see `Connections`.
+	ID   uint64
+	Kind ConnKind
+	// Name is the name of the listener or dialer of the connection.
+	Name string
+	// Conn is the tracked connection itself.
+	Conn     net.Conn
+	OpenedAt time.Time
+	// ListenerAddr is the address of the listener that accepted the connection, nil for dialed connections.
+	ListenerAddr net.Addr
+
+	stats *connStats
+}
+
+// BytesRead returns the number of bytes read from the connection so far.
+func (c *ObservedConn) BytesRead() uint64 {
+	return c.stats.bytesRead.Load()
+}
+
+// BytesWritten returns the number of bytes written to the connection so far.
+func (c *ObservedConn) BytesWritten() uint64 {
+	return c.stats.bytesWritten.Load()
+}
+
+// DialInfo is a dial, as seen by the hooks of `ConnObserver`.
+type DialInfo struct {
+	// Name is the name of the dialer, which can be overridden by `DialNameToContext`.
+	Name    string
+	Network string
+	Addr    string
+	// Attempt is the number of the attempt of the dial, starting at 1, see `DialWithRetries`.
+	Attempt int
+	Start   time.Time
+	// Duration is the time the dial took, set for OnDialDone.
+	Duration time.Duration
+	// FailureReason is the reason the dial failed for, e.g. `refused`, set for OnDialDone if it failed. It accounts for
+	// the error classifier of the dialer, see `DialWithErrorClassifier`.
+	FailureReason string
+}
+
+// observe notifies the given observers of the accepted or dialed connection, keeping them and the context they returned
+// for the later hooks.
+func (s *connStats) observe(ctx context.Context, observers []ConnObserver, notify func(context.Context, ConnObserver) context.Context) {
+	s.observers = observers
+	for _, observer := range observers {
+		ctx = notify(ctx, observer)
+	}
+	s.observerCtx = ctx
+}
+
+// transferObservers returns the observers to notify of Reads and Writes. The Prometheus ones are left out, since the
+// connections count their bytes to the collectors of these themselves, see `connStats.prometheus`.
+func transferObservers(observers []ConnObserver) []ConnObserver {
+	var transfer []ConnObserver
+	for _, observer := range observers {
+		if _, ok := observer.(*prometheusObserver); !ok {
+			transfer = append(transfer, observer)
+		}
+	}
+	return transfer
+}
+
+func (s *connStats) onRead(n int, err error) {
+	s.countRead(n)
+	s.recordError(err)
+	if n > 0 {
+		for _, state := range s.prometheus {
+			state.bytesRead.Add(float64(n))
+		}
+	}
+	for _, observer := range s.transferObservers {
+		observer.OnRead(s.observerCtx, &s.observed, n, err)
+	}
+}
+
+func (s *connStats) onWrite(n int, err error) {
+	s.countWritten(n)
+	s.recordError(err)
+	if n > 0 {
+		for _, state := range s.prometheus {
+			state.bytesWritten.Add(float64(n))
+		}
+	}
+	for _, observer := range s.transferObservers {
+		observer.OnWrite(s.observerCtx, &s.observed, n, err)
+	}
+}
+
+func (s *connStats) onClose(reason string, err error) {
+	for _, observer := range s.observers {
+		observer.OnClose(s.observerCtx, &s.observed, reason, err)
+	}
+}
+
+// NoopObserver implements all hooks of `ConnObserver` as no-ops. Embed it in your own observers to only implement the
+// hooks they need, and to keep them compiling as hooks are added to `ConnObserver`.
+type NoopObserver struct{}
+
+func (NoopObserver) OnAccept(ctx context.Context, _ *ObservedConn) context.Context {
+	return ctx
+}
+
+func (NoopObserver) OnDialStart(ctx context.Context, _ *DialInfo) context.Context {
+	return ctx
+}
+
+func (NoopObserver) OnDialDone(ctx context.Context, _ *DialInfo, _ *ObservedConn, _ error) context.Context {
+	return ctx
+}
+
+func (NoopObserver) OnRead(context.Context, *ObservedConn, int, error) {}
+
+func (NoopObserver) OnWrite(context.Context, *ObservedConn, int, error) {}
+
+func (NoopObserver) OnClose(context.Context, *ObservedConn, string, error) {}
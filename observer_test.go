@@ -0,0 +1,256 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingObserver records the hooks it is called for, checking that the context of a connection carries over.
+type recordingObserver struct {
+	mu           sync.Mutex
+	hooks        []string
+	bytesRead    int
+	bytesWritten int
+	dialErr      error
+	closedReason string
+	lostCtx      bool
+}
+
+func (o *recordingObserver) record(hook string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.hooks = append(o.hooks, hook)
+}
+
+func (o *recordingObserver) checkCtx(ctx context.Context) {
+	if ctx.Value(o) != o {
+		o.mu.Lock()
+		o.lostCtx = true
+		o.mu.Unlock()
+	}
+}
+
+func (o *recordingObserver) OnAccept(ctx context.Context, conn *conntrack.ObservedConn) context.Context {
+	o.record("accept")
+	return context.WithValue(ctx, o, o)
+}
+
+func (o *recordingObserver) OnDialStart(ctx context.Context, dial *conntrack.DialInfo) context.Context {
+	o.record("dial_start")
+	return context.WithValue(ctx, o, o)
+}
+
+func (o *recordingObserver) OnDialDone(ctx context.Context, dial *conntrack.DialInfo, conn *conntrack.ObservedConn, err error) context.Context {
+	o.checkCtx(ctx)
+	o.record("dial_done")
+	o.mu.Lock()
+	o.dialErr = err
+	o.mu.Unlock()
+	return ctx
+}
+
+func (o *recordingObserver) OnRead(ctx context.Context, conn *conntrack.ObservedConn, n int, err error) {
+	o.checkCtx(ctx)
+	o.mu.Lock()
+	o.bytesRead += n
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnWrite(ctx context.Context, conn *conntrack.ObservedConn, n int, err error) {
+	o.checkCtx(ctx)
+	o.mu.Lock()
+	o.bytesWritten += n
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnClose(ctx context.Context, conn *conntrack.ObservedConn, reason string, err error) {
+	o.checkCtx(ctx)
+	o.record("close")
+	o.mu.Lock()
+	o.closedReason = reason
+	o.mu.Unlock()
+}
+
+// closeReasonObserver only implements OnClose, embedding `conntrack.NoopObserver` for the other hooks.
+type closeReasonObserver struct {
+	conntrack.NoopObserver
+	reasons chan string
+}
+
+func (o *closeReasonObserver) OnClose(_ context.Context, _ *conntrack.ObservedConn, reason string, _ error) {
+	o.reasons <- reason
+}
+
+func TestNoopObserverEmbedding(t *testing.T) {
+	observer := &closeReasonObserver{reasons: make(chan string, 1)}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithObserver(observer))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	serverConn.Close()
+	assert.Equal(t, "local", <-observer.reasons, "the hook implemented by the observer must be called")
+}
+
+func TestObservers(t *testing.T) {
+	listenerObservers := []*recordingObserver{{}, {}}
+	dialerObserver := &recordingObserver{}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithObserver(listenerObservers[0]),
+		conntrack.TrackWithObserver(listenerObservers[1]))
+	defer listener.Close()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.DialWithObserver(dialerObserver))
+
+	clientConn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	_, err = clientConn.Write([]byte("ping"))
+	require.NoError(t, err, "writing must succeed")
+	_, err = io.ReadFull(serverConn, make([]byte, 4))
+	require.NoError(t, err, "reading must succeed")
+	clientConn.Close()
+	_, err = serverConn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "the peer must have closed the connection")
+	serverConn.Close()
+	serverConn.Close()
+
+	for _, observer := range listenerObservers {
+		assert.Equal(t, []string{"accept", "close"}, observer.hooks, "every observer of the listener must be notified once")
+		assert.Equal(t, 4, observer.bytesRead, "every observer must see the bytes read")
+		assert.Equal(t, "remote_eof", observer.closedReason, "every observer must see the reason of the close")
+		assert.False(t, observer.lostCtx, "the context returned by OnAccept must be passed to the later hooks")
+	}
+	assert.Equal(t, []string{"dial_start", "dial_done", "close"}, dialerObserver.hooks)
+	assert.Equal(t, 4, dialerObserver.bytesWritten, "the observer must see the bytes written")
+	assert.Equal(t, "local", dialerObserver.closedReason)
+	assert.False(t, dialerObserver.lostCtx, "the context returned by OnDialStart must be passed to the later hooks")
+
+	failedObserver := &recordingObserver{}
+	_, err = conntrack.NewDialContextFunc(
+		conntrack.DialWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.DialWithObserver(failedObserver))(context.TODO(), "tcp", "127.0.0.1:337")
+	require.Error(t, err, "dialing a closed port must fail")
+	assert.Equal(t, []string{"dial_start", "dial_done"}, failedObserver.hooks, "failed dials must not be closed")
+	assert.Equal(t, err, failedObserver.dialErr, "the observer must see the error of the dial")
+}
+
+func TestPrometheusObservers(t *testing.T) {
+	builtin, extra := prometheus.NewRegistry(), prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("prom_observers"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(builtin)),
+		conntrack.TrackWithObserver(conntrack.NewPrometheusObserver(conntrack.NewMetrics(extra))))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	_, err = clientConn.Write([]byte("ping"))
+	require.NoError(t, err, "writing must succeed")
+	_, err = io.ReadFull(serverConn, make([]byte, 4))
+	require.NoError(t, err, "reading must succeed")
+	_, err = serverConn.Write([]byte("pong!"))
+	require.NoError(t, err, "writing must succeed")
+	serverConn.Close()
+
+	for _, reg := range []*prometheus.Registry{builtin, extra} {
+		assert.Equal(t, 4, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_bytes_read_total", "prom_observers"),
+			"every Prometheus observer must count the bytes read")
+		assert.Equal(t, 5, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_bytes_written_total", "prom_observers"),
+			"every Prometheus observer must count the bytes written")
+		assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_closed_total", "prom_observers", "local"),
+			"every Prometheus observer must report the close")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("logger"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithLogger(logger, conntrack.LoggerWithLevel(conntrack.LogEventAccepted, slog.LevelDebug)))
+	defer listener.Close()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("logger"),
+		conntrack.DialWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.DialWithLogger(logger, conntrack.LoggerWithLevel(conntrack.LogEventDialFailed, slog.LevelError)))
+
+	clientConn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	_, err = clientConn.Write([]byte("ping"))
+	require.NoError(t, err, "writing must succeed")
+	_, err = io.ReadFull(serverConn, make([]byte, 4))
+	require.NoError(t, err, "reading must succeed")
+	serverConn.Close()
+	clientConn.Close()
+	_, err = dialFunc(context.TODO(), "tcp", "127.0.0.1:337")
+	require.Error(t, err, "dialing a closed port must fail")
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record), "records must be valid JSON")
+		records = append(records, record)
+	}
+	require.Len(t, records, 4, "all but the accept, whose level is disabled, must be logged")
+
+	established, serverClosed, clientClosed, failed := records[0], records[1], records[2], records[3]
+	assert.Equal(t, "established", established["event"])
+	assert.Equal(t, "INFO", established["level"])
+	assert.Equal(t, clientConn.LocalAddr().String(), established["local_addr"])
+	assert.Equal(t, listener.Addr().String(), established["remote_addr"])
+	assert.Contains(t, established, "duration", "the dial duration must be logged")
+
+	assert.Equal(t, "closed", serverClosed["event"])
+	assert.Equal(t, "listener", serverClosed["kind"])
+	assert.Equal(t, "logger", serverClosed["name"])
+	assert.EqualValues(t, 4, serverClosed["bytes_read"])
+	assert.Equal(t, "local", serverClosed["closed_reason"])
+	assert.Equal(t, "dialer", clientClosed["kind"])
+	assert.EqualValues(t, 4, clientClosed["bytes_written"])
+
+	assert.Equal(t, "dial_failed", failed["event"])
+	assert.Equal(t, "ERROR", failed["level"], "the level of the event must be overridden")
+	assert.Equal(t, "127.0.0.1:337", failed["addr"])
+	assert.Equal(t, "refused", failed["error_type"])
+	assert.Contains(t, failed, "error")
+}
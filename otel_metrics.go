@@ -0,0 +1,204 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const otelScopeName = "github.com/marefr/go-conntrack"
+
+const (
+	otelListenerNameKey = attribute.Key("conntrack.listener.name")
+	otelDialerNameKey   = attribute.Key("conntrack.dialer.name")
+	otelClosedReasonKey = attribute.Key("conntrack.closed_reason")
+	// The remaining keys follow the OpenTelemetry semantic conventions.
+	otelErrorTypeKey          = attribute.Key("error.type")
+	otelServerAddressKey      = attribute.Key("server.address")
+	otelServerPortKey         = attribute.Key("server.port")
+	otelNetworkPeerAddressKey = attribute.Key("network.peer.address")
+	otelNetworkPeerPortKey    = attribute.Key("network.peer.port")
+	otelNetworkTransportKey   = attribute.Key("network.transport")
+)
+
+// otelMetrics are the OpenTelemetry instruments of the listener and dialer metrics.
+type otelMetrics struct {
+	listenerAccepted metric.Int64Counter
+	listenerClosed   metric.Int64Counter
+	listenerOpen     metric.Int64UpDownCounter
+
+	dialerAttempted   metric.Int64Counter
+	dialerEstablished metric.Int64Counter
+	dialerFailed      metric.Int64Counter
+	dialerClosed      metric.Int64Counter
+	dialerOpen        metric.Int64UpDownCounter
+}
+
+func newOTelMetrics(provider metric.MeterProvider) *otelMetrics {
+	meter := provider.Meter(otelScopeName)
+	m := &otelMetrics{}
+	// Instruments that failed to be created are still usable no-ops, so report the errors and carry on.
+	var errs []error
+	int64Counter := func(name string, description string) metric.Int64Counter {
+		counter, err := meter.Int64Counter(name, metric.WithDescription(description), metric.WithUnit("{connection}"))
+		errs = append(errs, err)
+		return counter
+	}
+	int64UpDownCounter := func(name string, description string) metric.Int64UpDownCounter {
+		counter, err := meter.Int64UpDownCounter(name, metric.WithDescription(description), metric.WithUnit("{connection}"))
+		errs = append(errs, err)
+		return counter
+	}
+	m.listenerAccepted = int64Counter("conntrack.listener.connections.accepted",
+		"Number of connections opened to the listener.")
+	m.listenerClosed = int64Counter("conntrack.listener.connections.closed",
+		"Number of connections closed that were made to the listener, by the reason they were closed for.")
+	m.listenerOpen = int64UpDownCounter("conntrack.listener.connections.open",
+		"Number of open connections to the listener.")
+	m.dialerAttempted = int64Counter("conntrack.dialer.connections.attempted",
+		"Number of connections attempted by the dialer.")
+	m.dialerEstablished = int64Counter("conntrack.dialer.connections.established",
+		"Number of connections successfully established by the dialer.")
+	m.dialerFailed = int64Counter("conntrack.dialer.connections.failed",
+		"Number of connections failed to dial by the dialer, by the reason of the failure.")
+	m.dialerClosed = int64Counter("conntrack.dialer.connections.closed",
+		"Number of connections closed which originated from the dialer, by the reason they were closed for.")
+	m.dialerOpen = int64UpDownCounter("conntrack.dialer.connections.open",
+		"Number of open connections which originated from the dialer.")
+	if err := errors.Join(errs...); err != nil {
+		otel.Handle(err)
+	}
+	return m
+}
+
+// otelMetricsObserver reports connections as OpenTelemetry instruments, see `TrackWithMeterProvider` and
+// `DialWithMeterProvider`.
+type otelMetricsObserver struct {
+	NoopObserver
+	metrics *otelMetrics
+}
+
+// NewOTelMetricsObserver returns an observer reporting connections as OpenTelemetry instruments of the given provider,
+// which is what `TrackWithMeterProvider` and `DialWithMeterProvider` turn on.
+func NewOTelMetricsObserver(provider metric.MeterProvider) ConnObserver {
+	return &otelMetricsObserver{metrics: newOTelMetrics(provider)}
+}
+
+func (o *otelMetricsObserver) OnAccept(ctx context.Context, conn *ObservedConn) context.Context {
+	attrs := listenerOTelAttributes(conn.Name, conn.ListenerAddr)
+	o.metrics.reportListenerConnAccepted(attrs)
+	return context.WithValue(ctx, o, attrs)
+}
+
+func (o *otelMetricsObserver) OnDialStart(ctx context.Context, dial *DialInfo) context.Context {
+	o.metrics.reportDialerConnAttempt(ctx, dialerOTelAttributes(dial.Name, dial.Network, dial.Addr, nil))
+	return ctx
+}
+
+func (o *otelMetricsObserver) OnDialDone(ctx context.Context, dial *DialInfo, conn *ObservedConn, err error) context.Context {
+	if err != nil {
+		o.metrics.reportDialerConnFailed(ctx, dialerOTelAttributes(dial.Name, dial.Network, dial.Addr, nil), dial.FailureReason)
+		return ctx
+	}
+	attrs := dialerOTelAttributes(dial.Name, dial.Network, dial.Addr, conn.Conn)
+	o.metrics.reportDialerConnEstablished(ctx, attrs)
+	return context.WithValue(ctx, o, attrs)
+}
+
+func (o *otelMetricsObserver) OnClose(ctx context.Context, conn *ObservedConn, reason string, _ error) {
+	attrs, ok := ctx.Value(o).(attribute.Set)
+	if !ok {
+		return
+	}
+	if conn.Kind == ConnKindListener {
+		o.metrics.reportListenerConnClosed(attrs, reason)
+	} else {
+		o.metrics.reportDialerConnClosed(attrs, reason)
+	}
+}
+
+// listenerOTelAttributes returns the attributes of all connections of a listener. The address of the peers is left out,
+// since it would make for a time series per client.
+func listenerOTelAttributes(listenerName string, listenerAddr net.Addr) attribute.Set {
+	attrs := []attribute.KeyValue{otelListenerNameKey.String(listenerName)}
+	attrs = append(attrs, otelAddrAttributes(otelServerAddressKey, otelServerPortKey, listenerAddr.String())...)
+	attrs = append(attrs, otelNetworkTransportKey.String(otelNetworkTransport(listenerAddr.Network())))
+	return attribute.NewSet(attrs...)
+}
+
+// dialerOTelAttributes returns the attributes of a dial of the given address, as well as of the established
+// connection, which includes the address of the peer it resolved to.
+func dialerOTelAttributes(dialerName string, network string, addr string, conn net.Conn) attribute.Set {
+	attrs := []attribute.KeyValue{
+		otelDialerNameKey.String(dialerName),
+		otelNetworkTransportKey.String(otelNetworkTransport(network)),
+	}
+	attrs = append(attrs, otelAddrAttributes(otelServerAddressKey, otelServerPortKey, addr)...)
+	if conn != nil {
+		attrs = append(attrs, otelAddrAttributes(otelNetworkPeerAddressKey, otelNetworkPeerPortKey, conn.RemoteAddr().String())...)
+	}
+	return attribute.NewSet(attrs...)
+}
+
+func otelAddrAttributes(addressKey attribute.Key, portKey attribute.Key, addr string) []attribute.KeyValue {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// E.g. unix socket paths.
+		return []attribute.KeyValue{addressKey.String(addr)}
+	}
+	attrs := []attribute.KeyValue{addressKey.String(host)}
+	if portNumber, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, portKey.Int(portNumber))
+	}
+	return attrs
+}
+
+// otelNetworkTransport maps Go network names, e.g. `tcp4`, to the transports of the semantic conventions.
+func otelNetworkTransport(network string) string {
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return "tcp"
+	case strings.HasPrefix(network, "udp"):
+		return "udp"
+	case strings.HasPrefix(network, "unix"):
+		return "unix"
+	}
+	return network
+}
+
+func (m *otelMetrics) reportListenerConnAccepted(attrs attribute.Set) {
+	m.listenerAccepted.Add(context.Background(), 1, metric.WithAttributeSet(attrs))
+	m.listenerOpen.Add(context.Background(), 1, metric.WithAttributeSet(attrs))
+}
+
+func (m *otelMetrics) reportListenerConnClosed(attrs attribute.Set, reason string) {
+	m.listenerClosed.Add(context.Background(), 1, metric.WithAttributeSet(attrs), metric.WithAttributes(otelClosedReasonKey.String(reason)))
+	m.listenerOpen.Add(context.Background(), -1, metric.WithAttributeSet(attrs))
+}
+
+func (m *otelMetrics) reportDialerConnAttempt(ctx context.Context, attrs attribute.Set) {
+	m.dialerAttempted.Add(ctx, 1, metric.WithAttributeSet(attrs))
+}
+
+func (m *otelMetrics) reportDialerConnEstablished(ctx context.Context, attrs attribute.Set) {
+	m.dialerEstablished.Add(ctx, 1, metric.WithAttributeSet(attrs))
+	m.dialerOpen.Add(ctx, 1, metric.WithAttributeSet(attrs))
+}
+
+func (m *otelMetrics) reportDialerConnFailed(ctx context.Context, attrs attribute.Set, reason string) {
+	m.dialerFailed.Add(ctx, 1, metric.WithAttributeSet(attrs), metric.WithAttributes(otelErrorTypeKey.String(reason)))
+}
+
+func (m *otelMetrics) reportDialerConnClosed(attrs attribute.Set, reason string) {
+	m.dialerClosed.Add(context.Background(), 1, metric.WithAttributeSet(attrs), metric.WithAttributes(otelClosedReasonKey.String(reason)))
+	m.dialerOpen.Add(context.Background(), -1, metric.WithAttributeSet(attrs))
+}
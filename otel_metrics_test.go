@@ -0,0 +1,97 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// otelSum returns the sum of the data points of the named instrument that have all the given attributes.
+func otelSum(t *testing.T, reader sdkmetric.Reader, name string, attrs ...attribute.KeyValue) int64 {
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm), "metrics must be collected")
+	var sum int64
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+			data, ok := m.Data.(metricdata.Sum[int64])
+			require.True(t, ok, "%s must be an int64 sum", name)
+		points:
+			for _, point := range data.DataPoints {
+				for _, attr := range attrs {
+					if value, ok := point.Attributes.Value(attr.Key); !ok || value != attr.Value {
+						continue points
+					}
+				}
+				sum += point.Value
+			}
+		}
+	}
+	return sum
+}
+
+func TestOTelMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("otel"),
+		conntrack.TrackWithoutMonitoring(),
+		conntrack.TrackWithMeterProvider(provider))
+	defer listener.Close()
+	listenerPort := int64(listener.Addr().(*net.TCPAddr).Port)
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("otel"),
+		conntrack.DialWithoutMonitoring(),
+		conntrack.DialWithMeterProvider(provider))
+
+	clientConn, err := dialFunc(context.TODO(), "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	_, err = dialFunc(context.TODO(), "tcp", "127.0.0.1:337")
+	require.Error(t, err, "dialing a closed port must fail")
+
+	listenerAttrs := []attribute.KeyValue{
+		attribute.String("conntrack.listener.name", "otel"),
+		attribute.String("server.address", "127.0.0.1"),
+		attribute.Int64("server.port", listenerPort),
+		attribute.String("network.transport", "tcp"),
+	}
+	assert.EqualValues(t, 1, otelSum(t, reader, "conntrack.listener.connections.accepted", listenerAttrs...))
+	assert.EqualValues(t, 1, otelSum(t, reader, "conntrack.listener.connections.open", listenerAttrs...))
+	dialerAttrs := []attribute.KeyValue{
+		attribute.String("conntrack.dialer.name", "otel"),
+		attribute.String("server.address", "127.0.0.1"),
+		attribute.Int64("server.port", listenerPort),
+		attribute.String("network.peer.address", "127.0.0.1"),
+		attribute.Int64("network.peer.port", listenerPort),
+		attribute.String("network.transport", "tcp"),
+	}
+	assert.EqualValues(t, 2, otelSum(t, reader, "conntrack.dialer.connections.attempted", attribute.String("conntrack.dialer.name", "otel")))
+	assert.EqualValues(t, 1, otelSum(t, reader, "conntrack.dialer.connections.established", dialerAttrs...))
+	assert.EqualValues(t, 1, otelSum(t, reader, "conntrack.dialer.connections.open", dialerAttrs...))
+	assert.EqualValues(t, 1, otelSum(t, reader, "conntrack.dialer.connections.failed", attribute.Int64("server.port", 337), attribute.String("error.type", "refused")),
+		"the failed dial must be counted with its reason")
+
+	clientConn.Close()
+	serverConn.Close()
+	assert.EqualValues(t, 1, otelSum(t, reader, "conntrack.listener.connections.closed", append(listenerAttrs, attribute.String("conntrack.closed_reason", "local"))...))
+	assert.EqualValues(t, 0, otelSum(t, reader, "conntrack.listener.connections.open", listenerAttrs...))
+	assert.EqualValues(t, 1, otelSum(t, reader, "conntrack.dialer.connections.closed", append(dialerAttrs, attribute.String("conntrack.closed_reason", "local"))...))
+	assert.EqualValues(t, 0, otelSum(t, reader, "conntrack.dialer.connections.open", dialerAttrs...))
+}
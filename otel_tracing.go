@@ -0,0 +1,100 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	otelDialSpanName = "conntrack.dial"
+	otelConnSpanName = "conntrack.conn"
+
+	otelCloseEventName = "close"
+)
+
+// otelTracingObserver traces dials, and optionally the lifetime of dialed connections, as OpenTelemetry spans, see
+// `DialWithTracerProvider` and `DialWithConnectionSpans`.
+type otelTracingObserver struct {
+	NoopObserver
+	tracer    oteltrace.Tracer
+	connSpans bool
+}
+
+type otelDialSpanKey struct{ observer *otelTracingObserver }
+
+type otelConnSpanKey struct{ observer *otelTracingObserver }
+
+// otelConnSpan is the span of the lifetime of a connection.
+type otelConnSpan struct {
+	span oteltrace.Span
+}
+
+// NewOTelTracingObserver returns an observer tracing dials as OpenTelemetry spans of the given provider, which is
+// what `DialWithTracerProvider` turns on. With connSpans, the lifetime of the dialed connections is traced too, see
+// `DialWithConnectionSpans`. Accepted connections are not traced, since servers trace the requests they serve.
+func NewOTelTracingObserver(provider oteltrace.TracerProvider, connSpans bool) ConnObserver {
+	return &otelTracingObserver{tracer: provider.Tracer(otelScopeName), connSpans: connSpans}
+}
+
+// OnDialStart starts the span of a dial, as a child of the span of ctx if there is one. The returned context carries
+// the dial span, so that spans of the parent dialer, e.g. of DNS lookups, are its children.
+func (o *otelTracingObserver) OnDialStart(ctx context.Context, dial *DialInfo) context.Context {
+	attrs := dialerOTelAttributes(dial.Name, dial.Network, dial.Addr, nil)
+	ctx, span := o.tracer.Start(ctx, otelDialSpanName,
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(attrs.ToSlice()...))
+	return context.WithValue(ctx, otelDialSpanKey{o}, span)
+}
+
+// OnDialDone ends the span of a dial, with an error status if the dial failed.
+func (o *otelTracingObserver) OnDialDone(ctx context.Context, dial *DialInfo, conn *ObservedConn, err error) context.Context {
+	span, ok := ctx.Value(otelDialSpanKey{o}).(oteltrace.Span)
+	if !ok {
+		return ctx
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(otelErrorTypeKey.String(dial.FailureReason))
+		span.End()
+		return ctx
+	}
+	span.SetAttributes(otelAddrAttributes(otelNetworkPeerAddressKey, otelNetworkPeerPortKey, conn.Conn.RemoteAddr().String())...)
+	span.End()
+	if !o.connSpans {
+		return ctx
+	}
+	// Connections usually outlive the request they were dialed for, e.g. in a connection pool, so the span of their
+	// lifetime is the root of a new trace linked to the dial span.
+	attrs := dialerOTelAttributes(dial.Name, dial.Network, dial.Addr, conn.Conn)
+	_, connSpan := o.tracer.Start(context.Background(), otelConnSpanName,
+		oteltrace.WithNewRoot(),
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithLinks(oteltrace.Link{SpanContext: span.SpanContext()}),
+		oteltrace.WithAttributes(attrs.ToSlice()...))
+	return context.WithValue(ctx, otelConnSpanKey{o}, &otelConnSpan{span: connSpan})
+}
+
+// OnClose ends the span of the lifetime of a connection, with events for the terminal error of the connection, if any,
+// at the time it was returned by Read or Write, and for its close.
+func (o *otelTracingObserver) OnClose(ctx context.Context, conn *ObservedConn, reason string, err error) {
+	state, ok := ctx.Value(otelConnSpanKey{o}).(*otelConnSpan)
+	if !ok {
+		return
+	}
+	// The terminal error is the one the dialer classified the close reason from, with its own error classifier.
+	if terminalErr := conn.stats.terminalErr.Load(); terminalErr != nil {
+		state.span.RecordError(terminalErr.err, oteltrace.WithTimestamp(terminalErr.at))
+	}
+	state.span.AddEvent(otelCloseEventName, oteltrace.WithAttributes(otelClosedReasonKey.String(reason)))
+	if err != nil {
+		state.span.RecordError(err)
+		state.span.SetStatus(codes.Error, err.Error())
+	}
+	state.span.End()
+}
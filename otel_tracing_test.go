@@ -0,0 +1,164 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func findSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	require.Failf(t, "span not found", "span %s must have ended", name)
+	return nil
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestOTelDialSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, requestSpan := provider.Tracer("test").Start(context.Background(), "request")
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	defer listener.Close()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("otel_spans"),
+		conntrack.DialWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.DialWithTracerProvider(provider))
+
+	t.Run("established", func(t *testing.T) {
+		recorder.Reset()
+		conn, err := dialFunc(ctx, "tcp", listener.Addr().String())
+		require.NoError(t, err, "dialing the listener must succeed")
+		defer conn.Close()
+
+		dialSpan := findSpan(t, recorder, "conntrack.dial")
+		assert.Equal(t, requestSpan.SpanContext().SpanID(), dialSpan.Parent().SpanID(), "the dial span must be a child of the request span")
+		assert.Equal(t, requestSpan.SpanContext().TraceID(), dialSpan.SpanContext().TraceID(), "the dial span must be part of the request trace")
+		assert.Equal(t, codes.Unset, dialSpan.Status().Code)
+		assert.Equal(t, "otel_spans", spanAttribute(dialSpan, "conntrack.dialer.name").AsString())
+		assert.Equal(t, "127.0.0.1", spanAttribute(dialSpan, "network.peer.address").AsString())
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		recorder.Reset()
+		_, err := dialFunc(ctx, "tcp", "127.0.0.1:337")
+		require.Error(t, err, "dialing a closed port must fail")
+
+		dialSpan := findSpan(t, recorder, "conntrack.dial")
+		assert.Equal(t, requestSpan.SpanContext().SpanID(), dialSpan.Parent().SpanID(), "the dial span must be a child of the request span")
+		assert.Equal(t, codes.Error, dialSpan.Status().Code, "the failed dial must have an error status")
+		assert.Equal(t, "refused", spanAttribute(dialSpan, "error.type").AsString())
+		require.NotEmpty(t, dialSpan.Events(), "the error must be recorded")
+		assert.Equal(t, "exception", dialSpan.Events()[0].Name)
+	})
+}
+
+func TestOTelConnectionSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, requestSpan := provider.Tracer("test").Start(context.Background(), "request")
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner, conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)))
+	defer listener.Close()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("otel_conn_spans"),
+		conntrack.DialWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.DialWithTracerProvider(provider),
+		conntrack.DialWithConnectionSpans())
+
+	conn, err := dialFunc(ctx, "tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	serverConn, err := listener.Accept()
+	require.NoError(t, err, "the connection must be accepted")
+	serverConn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err, "the peer must have closed the connection")
+	for _, span := range recorder.Ended() {
+		assert.NotEqual(t, "conntrack.conn", span.Name(), "the connection span must not end before the connection is closed")
+	}
+	require.NoError(t, conn.Close())
+
+	dialSpan := findSpan(t, recorder, "conntrack.dial")
+	connSpan := findSpan(t, recorder, "conntrack.conn")
+	assert.NotEqual(t, requestSpan.SpanContext().TraceID(), connSpan.SpanContext().TraceID(), "the connection span must be the root of its own trace")
+	require.Len(t, connSpan.Links(), 1, "the connection span must be linked to the dial span")
+	assert.Equal(t, dialSpan.SpanContext().SpanID(), connSpan.Links()[0].SpanContext.SpanID())
+
+	var eventNames []string
+	for _, event := range connSpan.Events() {
+		eventNames = append(eventNames, event.Name)
+	}
+	assert.Equal(t, []string{"exception", "close"}, eventNames, "the first error and the close must be recorded")
+	closeEvent := connSpan.Events()[1]
+	assert.Contains(t, closeEvent.Attributes, attribute.String("conntrack.closed_reason", "remote_eof"))
+}
+
+// quotaConn is a connection whose reads fail with errQuotaExceeded.
+type quotaConn struct {
+	net.Conn
+}
+
+func (quotaConn) Read([]byte) (int, error) {
+	return 0, errQuotaExceeded
+}
+
+func TestOTelConnectionSpansWithErrorClassifier(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	pipeConn, otherConn := net.Pipe()
+	defer otherConn.Close()
+	dialFunc := conntrack.NewDialContextFunc(
+		conntrack.DialWithName("otel_classifier"),
+		conntrack.DialWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.DialWithTracerProvider(provider),
+		conntrack.DialWithConnectionSpans(),
+		conntrack.DialWithDialContextFunc(func(context.Context, string, string) (net.Conn, error) {
+			return quotaConn{pipeConn}, nil
+		}),
+		conntrack.DialWithErrorClassifier(func(err error) string {
+			if errors.Is(err, errQuotaExceeded) {
+				return "quota"
+			}
+			return ""
+		}, "quota"))
+
+	conn, err := dialFunc(context.Background(), "tcp", "quota:80")
+	require.NoError(t, err, "dialing must succeed")
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, errQuotaExceeded)
+	require.NoError(t, conn.Close())
+
+	connSpan := findSpan(t, recorder, "conntrack.conn")
+	require.Len(t, connSpan.Events(), 2, "the error classified by the dialer and the close must be recorded")
+	assert.Equal(t, "exception", connSpan.Events()[0].Name)
+	assert.Contains(t, connSpan.Events()[0].Attributes, attribute.String("exception.message", errQuotaExceeded.Error()))
+	assert.Contains(t, connSpan.Events()[1].Attributes, attribute.String("conntrack.closed_reason", "quota"))
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheusObserver reports the connections of listeners and dialers to the collectors of Metrics.
+type prometheusObserver struct {
+	NoopObserver
+	metrics  *Metrics
+	duration durationHistogramOpts
+}
+
+// prometheusConn holds the collectors of a connection, resolved once so that accounting a Read or Write is a single
+// atomic add. It's kept on the connection itself, see `connStats.prometheus`, which counts its Reads and Writes.
+type prometheusConn struct {
+	observer     *prometheusObserver
+	bytesRead    prometheus.Counter
+	bytesWritten prometheus.Counter
+	duration     prometheus.Observer
+}
+
+// NewPrometheusObserver returns an observer reporting connections to the given Metrics, which is what listeners and
+// dialers do unless `TrackWithoutMonitoring` or `DialWithoutMonitoring` is used. Unlike for these, the labels of the
+// listener and dialer names are not pre-populated.
+func NewPrometheusObserver(m *Metrics) ConnObserver {
+	return &prometheusObserver{metrics: m}
+}
+
+func (o *prometheusObserver) OnAccept(ctx context.Context, conn *ObservedConn) context.Context {
+	o.metrics.reportListenerConnAccepted(conn.Name)
+	state := &prometheusConn{observer: o, duration: o.metrics.listenerConnDurationObserver(conn.Name, o.duration)}
+	state.bytesRead, state.bytesWritten = o.metrics.listenerConnBytesCounters(conn.Name)
+	conn.stats.prometheus = append(conn.stats.prometheus, state)
+	return ctx
+}
+
+func (o *prometheusObserver) OnDialStart(ctx context.Context, dial *DialInfo) context.Context {
+	o.metrics.reportDialerConnAttempt(dial.Name)
+	if dial.Attempt > 1 {
+		o.metrics.reportDialerConnRetry(dial.Name)
+	}
+	return ctx
+}
+
+func (o *prometheusObserver) OnDialDone(ctx context.Context, dial *DialInfo, conn *ObservedConn, err error) context.Context {
+	if err != nil {
+		o.metrics.reportDialerConnFailed(dial.Name, dial.FailureReason, dial.Duration)
+		return ctx
+	}
+	o.metrics.reportDialerConnEstablished(dial.Name, dial.Duration)
+	state := &prometheusConn{observer: o, duration: o.metrics.dialerConnDurationObserver(conn.Name, o.duration)}
+	state.bytesRead, state.bytesWritten = o.metrics.dialerConnBytesCounters(conn.Name)
+	conn.stats.prometheus = append(conn.stats.prometheus, state)
+	return ctx
+}
+
+func (o *prometheusObserver) OnClose(_ context.Context, conn *ObservedConn, reason string, _ error) {
+	state := conn.stats.prometheusConn(o)
+	if state == nil {
+		return
+	}
+	if conn.Kind == ConnKindListener {
+		o.metrics.reportListenerConnClosed(conn.Name, reason, state.duration, conn.OpenedAt)
+	} else {
+		o.metrics.reportDialerConnClosed(conn.Name, reason, state.duration, conn.OpenedAt)
+	}
+}
+
+// prometheusConn returns the collectors of the connection for the given observer, nil if it didn't observe it.
+func (s *connStats) prometheusConn(o *prometheusObserver) *prometheusConn {
+	for _, state := range s.prometheus {
+		if state.observer == o {
+			return state
+		}
+	}
+	return nil
+}
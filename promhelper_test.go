@@ -9,15 +9,20 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/require"
 )
 
 func fetchPrometheusLines(t *testing.T, metricName string, matchingLabelValues ...string) []string {
+	return fetchPrometheusLinesFrom(t, prometheus.DefaultGatherer, metricName, matchingLabelValues...)
+}
+
+func fetchPrometheusLinesFrom(t *testing.T, gatherer prometheus.Gatherer, metricName string, matchingLabelValues ...string) []string {
 	resp := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/", nil)
 	require.NoError(t, err, "failed creating request for Prometheus handler")
-	promhttp.Handler().ServeHTTP(resp, req)
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(resp, req)
 	reader := bufio.NewReader(resp.Body)
 	ret := []string{}
 	for {
@@ -45,8 +50,12 @@ func fetchPrometheusLines(t *testing.T, metricName string, matchingLabelValues .
 }
 
 func sumCountersForMetricAndLabels(t *testing.T, metricName string, matchingLabelValues ...string) int {
+	return sumCountersForMetricAndLabelsFrom(t, prometheus.DefaultGatherer, metricName, matchingLabelValues...)
+}
+
+func sumCountersForMetricAndLabelsFrom(t *testing.T, gatherer prometheus.Gatherer, metricName string, matchingLabelValues ...string) int {
 	count := 0
-	for _, line := range fetchPrometheusLines(t, metricName, matchingLabelValues...) {
+	for _, line := range fetchPrometheusLinesFrom(t, gatherer, metricName, matchingLabelValues...) {
 		valueString := line[strings.LastIndex(line, " ")+1 : len(line)-1]
 		valueFloat, err := strconv.ParseFloat(valueString, 32)
 		require.NoError(t, err, "failed parsing value for line: %v", line)
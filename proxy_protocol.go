@@ -0,0 +1,344 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultProxyHeaderTimeout = 3 * time.Second
+	defaultProxyMaxPending    = 128
+
+	// proxyV1MaxLength is the maximum length of a v1 header line, including the CRLF.
+	proxyV1MaxLength = 107
+
+	rejectedProxyProtocol = "proxy_protocol"
+
+	proxyFailedTimeout = "timeout"
+	proxyFailedInvalid = "invalid"
+	proxyFailedRead    = "read_error"
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// ProxyProtocolConfig configures the parsing of PROXY protocol headers, see `TrackWithProxyProtocol`.
+type ProxyProtocolConfig struct {
+	// TrustedUpstreams lists the networks of the load balancers that send a PROXY protocol header. The header is
+	// mandatory for connections from these networks. Connections from other peers are accepted as they are, without
+	// reading a header. It must not be empty: since any peer could claim to be any client otherwise, every connection
+	// is rejected without trusted upstreams.
+	TrustedUpstreams []netip.Prefix
+	// HeaderTimeout bounds the time spent reading the header of a connection. Headers are read concurrently, so a
+	// stalling peer doesn't hold up the connections accepted after it. Defaults to 3 seconds.
+	HeaderTimeout time.Duration
+	// MaxPending bounds the number of connections either having their header read or waiting for Accept to be called.
+	// Once it is reached, no more connections are accepted from the inner listener until Accept takes one of them, so
+	// that stalling peers or a slow Accept loop can't exhaust file descriptors. Defaults to 128.
+	MaxPending int
+}
+
+// ProxyHeader is the PROXY protocol header received on a connection.
+type ProxyHeader struct {
+	// Version is the protocol version of the header, 1 or 2.
+	Version int
+	// Local is set for v1 `UNKNOWN` and v2 `LOCAL` headers, e.g. health checks of the load balancer itself. The
+	// connection then keeps the addresses of the load balancer.
+	Local bool
+	// SourceAddr is the address of the original client.
+	SourceAddr net.Addr
+	// DestinationAddr is the address the original client connected to.
+	DestinationAddr net.Addr
+	// TLVs are the type-length-value vectors of a v2 header.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a type-length-value vector of a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeaderFromConn returns the PROXY protocol header of a connection accepted from a listener using
+// `TrackWithProxyProtocol`, if any. Connections wrapped by `tls.Server` are supported too.
+func ProxyHeaderFromConn(conn net.Conn) (*ProxyHeader, bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tracked, ok := conn.(trackedConn); ok {
+		conn = tracked.innerConn()
+	}
+	if proxyConn, ok := conn.(*proxyProtocolConn); ok {
+		return proxyConn.header, proxyConn.header != nil
+	}
+	return nil, false
+}
+
+// proxyProtocolConn is a connection that had its PROXY protocol header read. It reports the address of the original
+// client and serves the bytes read past the header before reading from the connection again.
+type proxyProtocolConn struct {
+	net.Conn
+	header  *ProxyHeader
+	pending []byte
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// WriteTo serves the bytes read past the header before handing over to the connection, so that zero-copy transfers
+// are still possible.
+func (c *proxyProtocolConn) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	if len(c.pending) > 0 {
+		n, err := w.Write(c.pending)
+		c.pending = c.pending[n:]
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	var n int64
+	var err error
+	if src, ok := c.Conn.(io.WriterTo); ok {
+		n, err = src.WriteTo(w)
+	} else {
+		n, err = io.Copy(w, struct{ io.Reader }{c.Conn})
+	}
+	return written + n, err
+}
+
+// RemoteAddr returns the address of the original client. The address of the load balancer is kept for local headers
+// and for clients without an IP address, e.g. v2 `AF_UNIX` ones, which IP filters and per IP limits couldn't apply to.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.header.Local {
+		return c.Conn.RemoteAddr()
+	}
+	switch c.header.SourceAddr.(type) {
+	case *net.TCPAddr, *net.UDPAddr:
+		return c.header.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// trustsUpstream returns whether the given peer is expected to send a PROXY protocol header.
+func (cfg *ProxyProtocolConfig) trustsUpstream(remoteAddr net.Addr) bool {
+	ip, ok := remoteIP(remoteAddr)
+	if !ok {
+		return false
+	}
+	for _, prefix := range cfg.TrustedUpstreams {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol header of the given connection within the configured timeout. On failure,
+// the reason is returned for monitoring alongside the error.
+func (cfg *ProxyProtocolConfig) readProxyHeader(conn net.Conn) (*proxyProtocolConn, string, error) {
+	timeout := cfg.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, proxyFailedRead, err
+	}
+	reader := bufio.NewReaderSize(conn, 256)
+	header, err := parseProxyHeader(reader)
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return nil, proxyFailedTimeout, err
+		case errors.Is(err, errInvalidProxyHeader):
+			return nil, proxyFailedInvalid, err
+		}
+		return nil, proxyFailedRead, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, proxyFailedRead, err
+	}
+	proxyConn := &proxyProtocolConn{Conn: conn, header: header}
+	if buffered := reader.Buffered(); buffered > 0 {
+		proxyConn.pending, _ = reader.Peek(buffered)
+	}
+	return proxyConn, "", nil
+}
+
+func parseProxyHeader(reader *bufio.Reader) (*ProxyHeader, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Signature[0]:
+		return parseProxyHeaderV1(reader)
+	case proxyV2Signature[0]:
+		return parseProxyHeaderV2(reader)
+	}
+	return nil, fmt.Errorf("%w: missing signature", errInvalidProxyHeader)
+}
+
+func parseProxyHeaderV1(reader *bufio.Reader) (*ProxyHeader, error) {
+	line, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > proxyV1MaxLength {
+		return nil, fmt.Errorf("%w: v1 header too long", errInvalidProxyHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(line, proxyV1Signature) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: malformed v1 header", errInvalidProxyHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Local = true
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", errInvalidProxyHeader)
+	}
+	source, err := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	header.SourceAddr = source
+	header.DestinationAddr = destination
+	return header, nil
+}
+
+func parseProxyV1Addr(ip string, port string, is4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != is4 || addr.Zone() != "" {
+		return nil, fmt.Errorf("%w: invalid v1 address %q", errInvalidProxyHeader, ip)
+	}
+	// Leading zeros and signs are not allowed by the specification.
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("%w: invalid v1 port %q", errInvalidProxyHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(portNumber))), nil
+}
+
+func parseProxyHeaderV2(reader *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: missing signature", errInvalidProxyHeader)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported v2 version %d", errInvalidProxyHeader, fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("%w: unsupported v2 command %d", errInvalidProxyHeader, command)
+	}
+	family, transport := fixed[13]>>4, fixed[13]&0x0f
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2, Local: command == 0}
+	var addrLen int
+	switch family {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	}
+	if len(payload) < addrLen {
+		return nil, fmt.Errorf("%w: v2 addresses truncated", errInvalidProxyHeader)
+	}
+	if !header.Local && addrLen > 0 {
+		header.SourceAddr, header.DestinationAddr = parseProxyV2Addrs(family, transport, payload[:addrLen])
+	}
+	if header.SourceAddr == nil {
+		// Unspecified families and transports keep the addresses of the connection.
+		header.Local = true
+	}
+	tlvs, err := parseProxyV2TLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+	return header, nil
+}
+
+func parseProxyV2Addrs(family byte, transport byte, addrs []byte) (net.Addr, net.Addr) {
+	switch family {
+	case 0x1, 0x2:
+		ipLen := 4
+		if family == 0x2 {
+			ipLen = 16
+		}
+		srcIP, _ := netip.AddrFromSlice(addrs[:ipLen])
+		dstIP, _ := netip.AddrFromSlice(addrs[ipLen : 2*ipLen])
+		srcPort := binary.BigEndian.Uint16(addrs[2*ipLen:])
+		dstPort := binary.BigEndian.Uint16(addrs[2*ipLen+2:])
+		src, dst := netip.AddrPortFrom(srcIP, srcPort), netip.AddrPortFrom(dstIP, dstPort)
+		switch transport {
+		case 0x1:
+			return net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+		case 0x2:
+			return net.UDPAddrFromAddrPort(src), net.UDPAddrFromAddrPort(dst)
+		}
+	case 0x3:
+		network := "unix"
+		if transport == 0x2 {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Net: network, Name: string(bytes.TrimRight(addrs[:108], "\x00"))},
+			&net.UnixAddr{Net: network, Name: string(bytes.TrimRight(addrs[108:], "\x00"))}
+	}
+	return nil, nil
+}
+
+func parseProxyV2TLVs(data []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("%w: v2 TLV truncated", errInvalidProxyHeader)
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, fmt.Errorf("%w: v2 TLV truncated", errInvalidProxyHeader)
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: data[0], Value: data[3 : 3+length]})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marefr/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// localUpstreams trusts the test clients to send PROXY protocol headers.
+var localUpstreams = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+func proxyV2Header(command byte, family byte, addrs []byte, tlvs []byte) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)+len(tlvs)))
+	header = append(header, addrs...)
+	return append(header, tlvs...)
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	// A unix source address that reads like an IP must not be taken for one.
+	unixAddrs := make([]byte, 216)
+	copy(unixAddrs, "192.0.2.1:12345")
+	copy(unixAddrs[108:], "/run/lb.sock")
+	ipv6Addrs := append(append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...), 0x30, 0x39, 0x01, 0xbb)
+	for _, testCase := range []struct {
+		name       string
+		header     []byte
+		remoteAddr string
+		tlvs       []conntrack.ProxyTLV
+	}{
+		{"v1_tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"), "192.0.2.1:12345", nil},
+		{"v1_tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), "[2001:db8::1]:12345", nil},
+		{"v1_unknown", []byte("PROXY UNKNOWN\r\n"), "127.0.0.1", nil},
+		{"v2_tcp4", proxyV2Header(0x1, 0x11, []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x30, 0x39, 0x01, 0xbb}, nil), "192.0.2.1:12345", nil},
+		{"v2_tcp6_tlvs", proxyV2Header(0x1, 0x21, ipv6Addrs, []byte{0x02, 0x00, 0x03, 'f', 'o', 'o'}), "[2001:db8::1]:12345",
+			[]conntrack.ProxyTLV{{Type: 0x02, Value: []byte("foo")}}},
+		{"v2_local", proxyV2Header(0x0, 0x00, nil, nil), "127.0.0.1", nil},
+		{"v2_unix", proxyV2Header(0x1, 0x31, unixAddrs, nil), "127.0.0.1", nil},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err, "must be able to allocate a port")
+			listener := conntrack.NewListener(inner,
+				conntrack.TrackWithName("proxy_protocol"),
+				conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+				conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{TrustedUpstreams: localUpstreams}))
+			defer listener.Close()
+
+			clientConn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err, "dialing the listener must succeed")
+			defer clientConn.Close()
+			_, err = clientConn.Write(append(testCase.header, []byte("hello")...))
+			require.NoError(t, err, "writing the header must succeed")
+
+			conn, err := listener.Accept()
+			require.NoError(t, err, "the connection with a valid header must be accepted")
+			defer conn.Close()
+			assert.Contains(t, conn.RemoteAddr().String(), testCase.remoteAddr, "the remote address must be the one of the header")
+			payload := make([]byte, 5)
+			_, err = io.ReadFull(conn, payload)
+			require.NoError(t, err, "reading past the header must succeed")
+			assert.Equal(t, "hello", string(payload), "the data past the header must be preserved")
+			header, ok := conntrack.ProxyHeaderFromConn(conn)
+			require.True(t, ok, "the header must be available on the connection")
+			assert.Equal(t, testCase.tlvs, header.TLVs, "the TLVs of the header must be exposed")
+		})
+	}
+}
+
+func TestListenerProxyProtocolFailures(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		header []byte
+		reason string
+	}{
+		{"invalid", []byte("GET / HTTP/1.1\r\n\r\n"), "invalid"},
+		{"invalid_v1", []byte("PROXY TCP4 192.0.2.1 2001:db8::2 12345 443\r\n"), "invalid"},
+		{"invalid_v2", proxyV2Header(0x1, 0x11, []byte{192, 0, 2, 1}, nil), "invalid"},
+		{"timeout", nil, "timeout"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err, "must be able to allocate a port")
+			listener := conntrack.NewListener(inner,
+				conntrack.TrackWithName("proxy_protocol"),
+				conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+				conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{TrustedUpstreams: localUpstreams, HeaderTimeout: 50 * time.Millisecond}))
+			defer listener.Close()
+			go func() {
+				if conn, err := listener.Accept(); err == nil {
+					conn.Close()
+				}
+			}()
+
+			clientConn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err, "dialing the listener must succeed")
+			defer clientConn.Close()
+			_, err = clientConn.Write(testCase.header)
+			require.NoError(t, err, "writing the header must succeed")
+			require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+			_, err = clientConn.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF, "the connection with an invalid header must be closed by the listener")
+			assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_proxy_protocol_failed_total", "proxy_protocol", testCase.reason),
+				"the failure must be counted")
+			assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_rejected_total", "proxy_protocol", "proxy_protocol"),
+				"the connection must be counted as rejected")
+		})
+	}
+}
+
+func TestListenerProxyProtocolUntrustedUpstream(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("proxy_protocol"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{TrustedUpstreams: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}))
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	header := "PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"
+	_, err = clientConn.Write([]byte(header))
+	require.NoError(t, err, "writing the header must succeed")
+
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection of an untrusted peer must be accepted")
+	defer conn.Close()
+	assert.Equal(t, clientConn.LocalAddr().String(), conn.RemoteAddr().String(), "the header of an untrusted peer must be ignored")
+	payload := make([]byte, len(header))
+	_, err = io.ReadFull(conn, payload)
+	require.NoError(t, err, "reading the connection must succeed")
+	assert.Equal(t, header, string(payload), "the header of an untrusted peer must be passed through")
+	_, ok := conntrack.ProxyHeaderFromConn(conn)
+	assert.False(t, ok, "no header must be available on the connection")
+}
+
+func TestListenerProxyProtocolStallingPeer(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("proxy_protocol"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{
+			TrustedUpstreams: localUpstreams,
+			HeaderTimeout:    5 * time.Second,
+		}))
+	defer listener.Close()
+
+	silentConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer silentConn.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	_, err = clientConn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"))
+	require.NoError(t, err, "writing the header must succeed")
+
+	start := time.Now()
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection with a valid header must be accepted")
+	defer conn.Close()
+	assert.Less(t, time.Since(start), time.Second, "a peer not sending its header must not hold up Accept")
+	assert.Equal(t, "192.0.2.1:12345", conn.RemoteAddr().String())
+}
+
+// countingListener counts the connections accepted from the listener it wraps.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestListenerProxyProtocolMaxPending(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	counting := &countingListener{Listener: inner}
+	listener := conntrack.NewListener(counting,
+		conntrack.TrackWithName("proxy_protocol"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(nil)),
+		conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{
+			TrustedUpstreams: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			MaxPending:       2,
+		}))
+	defer listener.Close()
+
+	for i := 0; i < 5; i++ {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err, "dialing the listener must succeed")
+		defer clientConn.Close()
+	}
+	conn, err := listener.Accept()
+	require.NoError(t, err, "the connection of an untrusted peer must be accepted")
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return counting.accepted.Load() == 3
+	}, time.Second, 5*time.Millisecond, "the pending connections must be accepted from the inner listener")
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 3, counting.accepted.Load(), "no more than MaxPending connections must be accepted ahead of Accept")
+
+	for i := 0; i < 4; i++ {
+		conn, err := listener.Accept()
+		require.NoError(t, err, "the remaining connections must be accepted once Accept is called")
+		conn.Close()
+	}
+}
+
+func TestListenerProxyProtocolWithoutTrustedUpstreams(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port")
+	listener := conntrack.NewListener(inner,
+		conntrack.TrackWithName("proxy_protocol"),
+		conntrack.TrackWithMetrics(conntrack.NewMetrics(reg)),
+		conntrack.TrackWithProxyProtocol(conntrack.ProxyProtocolConfig{}))
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "dialing the listener must succeed")
+	defer clientConn.Close()
+	_, err = clientConn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"))
+	require.NoError(t, err, "writing the header must succeed")
+	require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "without trusted upstreams, no peer must be able to claim to be another client")
+	assert.Equal(t, 1, sumCountersForMetricAndLabelsFrom(t, reg, "net_conntrack_listener_conn_rejected_total", "proxy_protocol", "proxy_protocol"),
+		"the connection must be counted as rejected")
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package conntrack
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// LogEvent is a connection event logged by `TrackWithLogger`, `DialWithLogger` and `NewSlogObserver`.
+type LogEvent string
+
+const (
+	// LogEventAccepted is a connection accepted by a listener, logged at info level by default.
+	LogEventAccepted LogEvent = "accepted"
+	// LogEventEstablished is a connection established by a dialer, logged at info level by default.
+	LogEventEstablished LogEvent = "established"
+	// LogEventDialFailed is a dial that failed, logged at warn level by default.
+	LogEventDialFailed LogEvent = "dial_failed"
+	// LogEventClosed is a connection closed, logged at info level by default.
+	LogEventClosed LogEvent = "closed"
+)
+
+type loggerOpts struct {
+	levels map[LogEvent]slog.Level
+}
+
+// LoggerOpt defines a config option you can set on the logging of connections.
+type LoggerOpt func(*loggerOpts)
+
+// LoggerWithLevel overrides the level the given event is logged at. Events can be left out by using a level the
+// handler of the logger doesn't enable, e.g. `slog.LevelDebug`.
+func LoggerWithLevel(event LogEvent, level slog.Level) LoggerOpt {
+	return func(opts *loggerOpts) {
+		opts.levels[event] = level
+	}
+}
+
+// slogObserver logs the lifecycle of connections as structured records.
+type slogObserver struct {
+	NoopObserver
+	logger *slog.Logger
+	levels map[LogEvent]slog.Level
+}
+
+// NewSlogObserver returns an observer logging accepted, dialed and closed connections, as well as failed dials, to the
+// given logger, which is what `TrackWithLogger` and `DialWithLogger` turn on.
+func NewSlogObserver(logger *slog.Logger, optFuncs ...LoggerOpt) ConnObserver {
+	opts := &loggerOpts{
+		levels: map[LogEvent]slog.Level{
+			LogEventAccepted:    slog.LevelInfo,
+			LogEventEstablished: slog.LevelInfo,
+			LogEventDialFailed:  slog.LevelWarn,
+			LogEventClosed:      slog.LevelInfo,
+		},
+	}
+	for _, f := range optFuncs {
+		f(opts)
+	}
+	return &slogObserver{logger: logger, levels: opts.levels}
+}
+
+func (o *slogObserver) log(ctx context.Context, event LogEvent, msg string, attrs ...slog.Attr) {
+	level := o.levels[event]
+	if !o.logger.Enabled(ctx, level) {
+		return
+	}
+	o.logger.LogAttrs(ctx, level, msg, append([]slog.Attr{slog.String("event", string(event))}, attrs...)...)
+}
+
+func (o *slogObserver) OnAccept(ctx context.Context, conn *ObservedConn) context.Context {
+	o.log(ctx, LogEventAccepted, "connection accepted", slogConnAttrs(conn)...)
+	return ctx
+}
+
+func (o *slogObserver) OnDialDone(ctx context.Context, dial *DialInfo, conn *ObservedConn, err error) context.Context {
+	if err != nil {
+		o.log(ctx, LogEventDialFailed, "dial failed",
+			slog.String("kind", string(ConnKindDialer)),
+			slog.String("name", dial.Name),
+			slog.String("network", dial.Network),
+			slog.String("addr", dial.Addr),
+			slog.Duration("duration", dial.Duration),
+			slog.Int("attempt", dial.Attempt),
+			slog.String("error_type", dial.FailureReason),
+			slog.Any("error", err))
+		return ctx
+	}
+	o.log(ctx, LogEventEstablished, "connection established", append(slogConnAttrs(conn),
+		slog.String("network", dial.Network),
+		slog.String("addr", dial.Addr),
+		slog.Duration("duration", dial.Duration))...)
+	return ctx
+}
+
+func (o *slogObserver) OnClose(ctx context.Context, conn *ObservedConn, reason string, err error) {
+	attrs := append(slogConnAttrs(conn),
+		slog.Duration("duration", time.Since(conn.OpenedAt)),
+		slog.Uint64("bytes_read", conn.BytesRead()),
+		slog.Uint64("bytes_written", conn.BytesWritten()),
+		slog.String("closed_reason", reason))
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	o.log(ctx, LogEventClosed, "connection closed", attrs...)
+}
+
+func slogConnAttrs(conn *ObservedConn) []slog.Attr {
+	return []slog.Attr{
+		slog.String("kind", string(conn.Kind)),
+		slog.String("name", conn.Name),
+		slog.Uint64("id", conn.ID),
+		slog.String("local_addr", conn.Conn.LocalAddr().String()),
+		slog.String("remote_addr", conn.Conn.RemoteAddr().String()),
+	}
+}